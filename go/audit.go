@@ -0,0 +1,462 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	"net"
+	"net/rpc"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ***************************************************************************
+// SQLITE3 PRIVATE DB
+// ***************************************************************************
+
+type Enc struct {
+	Id        int64
+	SaltId    string // Name of the server
+	Formula   string // Directory name
+	StateFile string // Sls file name
+	Dc        string // Data centre name
+	Env       string // Environment name
+	Untested  bool   // Cidr regexes that may give classes were not tested
+}
+
+type Regex struct {
+	Id         int64
+	Regex      string // The regular expression
+	Dc         string // Data centre name
+	Env        string // Environment name
+	Name       string // Short name for the regex, no spaces
+	Desc       string // Description of the regex
+	Priority   int64  // Higher priority regexes take precedence
+	Rule       string // "include" (or empty) adds classes, "exclude" removes
+	MatchType  string // "pcre" (or empty), "glob", "list" or "cidr"
+	IgnoreCase bool   // Match salt ids case insensitively
+	FullMatch  bool   // A pcre regex must match the whole salt id
+}
+
+type RegexSlsMap struct {
+	Id        int64
+	RegexId   int64  // Not null
+	Formula   string // Not null
+	StateFile string // Can be null, dotted if nested, e.g. mods.ssl
+}
+
+type HostOverride struct {
+	Id        int64
+	SaltId    string // Name of the server
+	Formula   string // Not null
+	StateFile string // Can be null, dotted if nested, e.g. mods.ssl
+	Action    string // "add" or "remove" the class
+	Dc        string // Data centre name
+	Env       string // Environment name
+}
+
+type Audit struct {
+	Id      int64
+	Login   string    // Who made the change
+	Time    time.Time // When the change was saved, in UTC
+	Dc      string    // Data centre name
+	Env     string    // Environment name
+	Action  string    // "create", "update" or "delete"
+	Kind    string    // "regex" or "classes"
+	RegexId int64     // The regex that changed, or whose classes changed
+	Before  string    // JSON of the values before, empty if created
+	After   string    // JSON of the values after, empty if deleted
+}
+
+type Revision struct {
+	Id       int64
+	Dc       string    // Data centre name
+	Env      string    // Environment name
+	Number   int64     // Counts up from 1 in each environment
+	Login    string    // Who made the change
+	Time     time.Time // When the change was saved, in UTC
+	Reason   string    // What changed
+	Snapshot string    // JSON of the regexes and their classes afterwards
+}
+
+// --
+
+var config *Config
+
+type Config struct {
+	Dbname   string
+	Portlock *PortLock
+	Port     int
+}
+
+func (c *Config) DBPath() string {
+
+	return c.Dbname
+}
+
+func (c *Config) SetDBPath(path string) {
+
+	c.Dbname = path
+}
+
+func NewConfig() {
+
+	config = &Config{}
+}
+
+// --
+
+type GormDB struct {
+	db gorm.DB
+}
+
+func (gormInst *GormDB) InitDB() error {
+
+	var err error
+	dbname := config.DBPath()
+
+	gormInst.db, err = gorm.Open("sqlite3", dbname+"enc.db")
+	if err != nil {
+		return ApiError{"Open " + dbname + " failed. " + err.Error()}
+	}
+
+	if err := gormInst.db.AutoMigrate(Enc{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate Enc table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(Regex{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate Regex table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(RegexSlsMap{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate RegexSlsMap table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(HostOverride{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate HostOverride table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(Audit{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate Audit table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(Revision{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate Revision table failed: %s", err)
+		return ApiError{txt}
+	}
+
+	// Unique index is also a constraint, so are forced to be unique
+	gormInst.db.Model(Enc{}).AddIndex("idx_enc_salt_id", "salt_id")
+	gormInst.db.Model(HostOverride{}).AddIndex("idx_host_override_salt_id",
+		"salt_id")
+	gormInst.db.Model(Audit{}).AddIndex("idx_audit_dc_env", "dc", "env")
+	gormInst.db.Model(Revision{}).AddIndex("idx_revision_dc_env", "dc", "env")
+
+	return nil
+}
+
+func (gormInst *GormDB) DB() *gorm.DB {
+
+	return &gormInst.db
+}
+
+func NewDB() (*GormDB, error) {
+
+	gormInst := &GormDB{}
+	if err := gormInst.InitDB(); err != nil {
+		return gormInst, err
+	}
+	return gormInst, nil
+}
+
+// ***************************************************************************
+// PORT LOCKING
+// ***************************************************************************
+
+// PortLock is a locker which locks by binding to a port on the loopback IPv4
+// interface
+type PortLock struct {
+	hostport string
+	ln       net.Listener
+}
+
+func NewPortLock(port int) *PortLock {
+
+	// NewFLock creates new Flock-based lock (unlocked first)
+	return &PortLock{hostport: net.JoinHostPort("127.0.0.1", strconv.Itoa(port))}
+}
+
+func (p *PortLock) Lock() {
+
+	// Lock acquires the lock, blocking
+	t := 50 * time.Millisecond
+	for {
+		if l, err := net.Listen("tcp", p.hostport); err == nil {
+			p.ln = l // thanks to zhangpy
+			return
+		}
+		//log.Printf("spinning lock on %s (%s)", p.hostport, err)
+		time.Sleep(t)
+		//t = time.Duration(
+		//  math.Min( float64(time.Duration(float32(t) * 1.5)), 2000 ))
+	}
+}
+
+func (p *PortLock) Unlock() {
+
+	// Unlock releases the lock
+	if p.ln != nil {
+		p.ln.Close()
+	}
+}
+
+// ***************************************************************************
+// GO RPC PLUGIN
+// ***************************************************************************
+
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// An audit record with the before and after values as JSON, or null
+type AuditOut struct {
+	Id      int64
+	Login   string
+	Time    time.Time
+	Dc      string
+	Env     string
+	Action  string
+	Kind    string
+	RegexId int64
+	Before  json.RawMessage
+	After   json.RawMessage
+}
+
+func RawJson(text string) json.RawMessage {
+
+	// Return stored JSON text as-is for marshalling, or null if empty
+
+	if len(text) == 0 {
+		return json.RawMessage("null")
+	}
+	return json.RawMessage(text)
+}
+
+func Unlock() {
+
+	config.Portlock.Unlock()
+}
+
+func Lock() {
+
+	config.Portlock.Lock()
+}
+
+func (t *Plugin) GetRequest(args *Args, response *[]byte) error {
+
+	// Return the audit trail for an environment, newest first. It can be
+	// filtered by 'login', 'action', 'kind' and 'regex_id', and by time
+	// with 'since' and 'until' in RFC 3339 format, e.g.
+	// 2006-01-02T15:04:05Z. 'limit' sets the number of records returned,
+	// 100 by default.
+
+	if len(args.QueryString["env_id"]) == 0 {
+		ReturnError("'env_id' must be set", response)
+		return nil
+	}
+
+	env_id_str := args.QueryString["env_id"][0]
+
+	// Check if the user is allowed to access the environment
+	var err error
+	var foundenv Env
+	if foundenv, err = t.GetAllowedEnv(args, env_id_str, response); err != nil {
+		// GetAllowedEnv wrote the error
+		return nil
+	}
+
+	dc := foundenv.DcSysName
+	env := foundenv.SysName
+
+	// PluginDatabasePath is required to open our private db
+	if len(args.PathParams["PluginDatabasePath"]) == 0 {
+		ReturnError("Internal Error: 'PluginDatabasePath' must be set", response)
+		return nil
+	}
+
+	config.SetDBPath(args.PathParams["PluginDatabasePath"])
+
+	// Open/Create database
+	var gormInst *GormDB
+	if gormInst, err = NewDB(); err != nil {
+		txt := "GormDB open error for '" + config.DBPath() + "enc.db'. " +
+			err.Error()
+		ReturnError(txt, response)
+		return nil
+	}
+
+	db := gormInst.DB() // shortcut
+
+	// Build the query from the filters
+
+	query := db.Where("dc = ? and env = ?", dc, env)
+
+	for _, field := range []string{"login", "action", "kind"} {
+		if len(args.QueryString[field]) > 0 {
+			query = query.Where(field+" = ?", args.QueryString[field][0])
+		}
+	}
+
+	if len(args.QueryString["regex_id"]) > 0 {
+		regex_id, err := strconv.ParseInt(args.QueryString["regex_id"][0], 10, 64)
+		if err != nil {
+			ReturnError("'regex_id' must be a number", response)
+			return nil
+		}
+		query = query.Where("regex_id = ?", regex_id)
+	}
+
+	if len(args.QueryString["since"]) > 0 {
+		since, err := time.Parse(time.RFC3339, args.QueryString["since"][0])
+		if err != nil {
+			ReturnError("'since' must be an RFC 3339 time. "+err.Error(), response)
+			return nil
+		}
+		query = query.Where("time >= ?", since.UTC())
+	}
+
+	if len(args.QueryString["until"]) > 0 {
+		until, err := time.Parse(time.RFC3339, args.QueryString["until"][0])
+		if err != nil {
+			ReturnError("'until' must be an RFC 3339 time. "+err.Error(), response)
+			return nil
+		}
+		query = query.Where("time < ?", until.UTC())
+	}
+
+	limit := DefaultLimit
+	if len(args.QueryString["limit"]) > 0 {
+		limit, err = strconv.Atoi(args.QueryString["limit"][0])
+		if err != nil || limit < 1 || limit > MaxLimit {
+			ReturnError(fmt.Sprintf("'limit' must be a number from 1 to %d",
+				MaxLimit), response)
+			return nil
+		}
+	}
+
+	audits := []Audit{}
+	Lock()
+	if err := query.Order("id desc").Limit(limit).Find(&audits); err.Error != nil {
+		if !err.RecordNotFound() {
+			Unlock()
+			ReturnError(err.Error.Error(), response)
+			return nil
+		}
+	}
+	Unlock()
+
+	// Output as JSON
+
+	out := []AuditOut{}
+	for _, audit := range audits {
+		out = append(out, AuditOut{
+			Id:      audit.Id,
+			Login:   audit.Login,
+			Time:    audit.Time,
+			Dc:      audit.Dc,
+			Env:     audit.Env,
+			Action:  audit.Action,
+			Kind:    audit.Kind,
+			RegexId: audit.RegexId,
+			Before:  RawJson(audit.Before),
+			After:   RawJson(audit.After),
+		})
+	}
+
+	TempJsonData, err := json.Marshal(out)
+	if err != nil {
+		ReturnError("Marshal error: "+err.Error(), response)
+		return nil
+	}
+	reply := Reply{0, string(TempJsonData), SUCCESS, ""}
+	jsondata, err := json.Marshal(reply)
+
+	if err != nil {
+		ReturnError("Marshal error: "+err.Error(), response)
+		return nil
+	}
+
+	*response = jsondata
+
+	return nil
+}
+
+func (t *Plugin) HandleRequest(args *Args, response *[]byte) error {
+
+	// All plugins must have this.
+
+	if len(args.QueryType) > 0 {
+		switch args.QueryType {
+		case "GET":
+			t.GetRequest(args, response)
+			return nil
+		}
+		ReturnError("Internal error: Invalid HTTP request type for this plugin "+
+			args.QueryType, response)
+		return nil
+	} else {
+		ReturnError("Internal error: HTTP request type was not set", response)
+		return nil
+	}
+}
+
+// ***************************************************************************
+// ENTRY POINT
+// ***************************************************************************
+
+func main() {
+
+	// Sets the global config var
+	NewConfig()
+
+	// Create a lock file to use for synchronisation
+	config.Port = 49993
+	config.Portlock = NewPortLock(config.Port)
+
+	plugin := new(Plugin)
+	rpc.Register(plugin)
+
+	listener, err := net.Listen("tcp", ":"+os.Args[1])
+	if err != nil {
+		txt := fmt.Sprintf("Listen error. %s", err)
+		logit(txt)
+	}
+
+	if conn, err := listener.Accept(); err != nil {
+		txt := fmt.Sprintf("Accept error. %s", err)
+		logit(txt)
+	} else {
+		rpc.ServeConn(conn)
+	}
+}
+
+// vim:ts=2:sw=2
@@ -0,0 +1,2089 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	"gopkg.in/yaml.v2"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ***************************************************************************
+// SQLITE3 PRIVATE DB
+// ***************************************************************************
+
+type Enc struct {
+	Id        int64
+	SaltId    string // Name of the server
+	Formula   string // Directory name
+	StateFile string // Sls file name
+	Dc        string // Data centre name
+	Env       string // Environment name
+	Untested  bool   // Cidr regexes that may give classes were not tested
+}
+
+type Regex struct {
+	Id         int64
+	Regex      string // The regular expression
+	Dc         string // Data centre name
+	Env        string // Environment name
+	Name       string // Short name for the regex, no spaces
+	Desc       string // Description of the regex
+	Priority   int64  // Higher priority regexes take precedence
+	Rule       string // "include" (or empty) adds classes, "exclude" removes
+	MatchType  string // "pcre" (or empty), "glob", "list" or "cidr"
+	IgnoreCase bool   // Match salt ids case insensitively
+	FullMatch  bool   // A pcre regex must match the whole salt id
+}
+
+const (
+	RuleInclude = "include"
+	RuleExclude = "exclude"
+)
+
+type RegexSlsMap struct {
+	Id        int64
+	RegexId   int64  // Not null
+	Formula   string // Not null
+	StateFile string // Can be null, dotted if nested, e.g. mods.ssl
+}
+
+type HostOverride struct {
+	Id        int64
+	SaltId    string // Name of the server
+	Formula   string // Not null
+	StateFile string // Can be null, dotted if nested, e.g. mods.ssl
+	Action    string // "add" or "remove" the class
+	Dc        string // Data centre name
+	Env       string // Environment name
+}
+
+const (
+	ActionAdd    = "add"
+	ActionRemove = "remove"
+)
+
+type Audit struct {
+	Id      int64
+	Login   string    // Who made the change
+	Time    time.Time // When the change was saved, in UTC
+	Dc      string    // Data centre name
+	Env     string    // Environment name
+	Action  string    // "create", "update" or "delete"
+	Kind    string    // "regex" or "classes"
+	RegexId int64     // The regex that changed, or whose classes changed
+	Before  string    // JSON of the values before, empty if created
+	After   string    // JSON of the values after, empty if deleted
+}
+
+type Revision struct {
+	Id       int64
+	Dc       string    // Data centre name
+	Env      string    // Environment name
+	Number   int64     // Counts up from 1 in each environment
+	Login    string    // Who made the change
+	Time     time.Time // When the change was saved, in UTC
+	Reason   string    // What changed
+	Snapshot string    // JSON of the regexes and their classes afterwards
+}
+
+// --
+
+var config *Config
+
+type Config struct {
+	Dbname   string
+	Portlock *PortLock
+	Port     int
+}
+
+func (c *Config) DBPath() string {
+
+	return c.Dbname
+}
+
+func (c *Config) SetDBPath(path string) {
+
+	c.Dbname = path
+}
+
+func NewConfig() {
+
+	config = &Config{}
+}
+
+// --
+
+type GormDB struct {
+	db gorm.DB
+}
+
+func (gormInst *GormDB) InitDB() error {
+
+	var err error
+	dbname := config.DBPath()
+
+	gormInst.db, err = gorm.Open("sqlite3", dbname+"enc.db")
+	if err != nil {
+		return ApiError{"Open " + dbname + " failed. " + err.Error()}
+	}
+
+	if err := gormInst.db.AutoMigrate(Enc{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate Enc table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(Regex{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate Regex table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(RegexSlsMap{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate RegexSlsMap table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(HostOverride{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate HostOverride table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(Audit{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate Audit table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(Revision{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate Revision table failed: %s", err)
+		return ApiError{txt}
+	}
+
+	// Unique index is also a constraint, so are forced to be unique
+	gormInst.db.Model(Enc{}).AddIndex("idx_enc_salt_id", "salt_id")
+	gormInst.db.Model(HostOverride{}).AddIndex("idx_host_override_salt_id",
+		"salt_id")
+	gormInst.db.Model(Audit{}).AddIndex("idx_audit_dc_env", "dc", "env")
+	gormInst.db.Model(Revision{}).AddIndex("idx_revision_dc_env", "dc", "env")
+
+	return nil
+}
+
+func (gormInst *GormDB) DB() *gorm.DB {
+
+	return &gormInst.db
+}
+
+func NewDB() (*GormDB, error) {
+
+	gormInst := &GormDB{}
+	if err := gormInst.InitDB(); err != nil {
+		return gormInst, err
+	}
+	return gormInst, nil
+}
+
+// ***************************************************************************
+// PORT LOCKING
+// ***************************************************************************
+
+// PortLock is a locker which locks by binding to a port on the loopback IPv4
+// interface
+type PortLock struct {
+	hostport string
+	ln       net.Listener
+}
+
+func NewPortLock(port int) *PortLock {
+
+	// NewFLock creates new Flock-based lock (unlocked first)
+	return &PortLock{hostport: net.JoinHostPort("127.0.0.1", strconv.Itoa(port))}
+}
+
+func (p *PortLock) Lock() {
+
+	// Lock acquires the lock, blocking
+	t := 50 * time.Millisecond
+	for {
+		if l, err := net.Listen("tcp", p.hostport); err == nil {
+			p.ln = l // thanks to zhangpy
+			return
+		}
+		//log.Printf("spinning lock on %s (%s)", p.hostport, err)
+		time.Sleep(t)
+		//t = time.Duration(
+		//  math.Min( float64(time.Duration(float32(t) * 1.5)), 2000 ))
+	}
+}
+
+func (p *PortLock) Unlock() {
+
+	// Unlock releases the lock
+	if p.ln != nil {
+		p.ln.Close()
+	}
+}
+
+// ***************************************************************************
+// MATCH TYPES
+// ***************************************************************************
+
+const (
+	MatchPcre = "pcre" // A regular expression, the default
+	MatchGlob = "glob" // A shell style glob, e.g. web*
+	MatchList = "list" // A comma separated list of salt ids
+	MatchCidr = "cidr" // Comma separated networks matched against the address
+)
+
+func GlobToRegex(glob string) string {
+
+	// Convert a shell style glob, as used by Salt's glob matcher, to an
+	// anchored regex
+
+	expr := "^"
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			expr += ".*"
+		case '?':
+			expr += "."
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				expr += regexp.QuoteMeta(string(c))
+				continue
+			}
+			// fnmatch negates a set with !, and a ^ in it is just a ^
+			set := strings.Replace(glob[i+1:i+1+end], `\`, `\\`, -1)
+			if strings.HasPrefix(set, "!") {
+				set = "^" + set[1:]
+			} else if strings.HasPrefix(set, "^") {
+				set = `\` + set
+			}
+			expr += "[" + set + "]"
+			i += end + 1
+		default:
+			expr += regexp.QuoteMeta(string(c))
+		}
+	}
+
+	return expr + "$"
+}
+
+func SplitList(list string) []string {
+
+	// Return the non-empty items of a comma separated list
+
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func ListToRegex(list string) string {
+
+	// Convert a comma separated list of salt ids to an anchored regex
+
+	saltids := SplitList(list)
+	for i := range saltids {
+		saltids[i] = regexp.QuoteMeta(saltids[i])
+	}
+
+	return "^(?:" + strings.Join(saltids, "|") + ")$"
+}
+
+func ParseNets(cidrs string) ([]*net.IPNet, error) {
+
+	// Parse a comma separated list of networks, e.g. 10.1.0.0/16, or single
+	// addresses
+
+	nets := []*net.IPNet{}
+	for _, cidr := range SplitList(cidrs) {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nets, ApiError{"'" + cidr + "' is not an address or network"}
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nets, ApiError{"'" + cidr + "' is not an address or network"}
+		}
+		nets = append(nets, ipnet)
+	}
+
+	if len(nets) == 0 {
+		return nets, ApiError{"no networks given"}
+	}
+
+	return nets, nil
+}
+
+func MatchExpr(regex Regex) string {
+
+	// Return the regex that salt ids are tested against for a pcre, glob or
+	// list match, with the regex's IgnoreCase and FullMatch flags applied
+
+	expr := regex.Regex
+	switch regex.MatchType {
+	case MatchGlob:
+		expr = GlobToRegex(expr)
+	case MatchList:
+		expr = ListToRegex(expr)
+	default:
+		if regex.FullMatch {
+			expr = "^(?:" + expr + ")$"
+		}
+	}
+	if regex.IgnoreCase {
+		expr = "(?i)" + expr
+	}
+
+	return expr
+}
+
+func MatchRegexp(regex Regex) (*regexp.Regexp, error) {
+
+	// Return the compiled regex that salt ids are tested against for any
+	// match type. Cidr matches test the host's address instead so have no
+	// regex.
+
+	if regex.MatchType == MatchCidr {
+		_, err := ParseNets(regex.Regex)
+		return nil, err
+	}
+
+	return regexp.Compile(MatchExpr(regex))
+}
+
+// ***************************************************************************
+// VALIDATION
+// ***************************************************************************
+
+const (
+	MaxNameLength  = 64
+	MaxRegexLength = 1024
+)
+
+// Details of a field that failed validation. Position is the offset of the
+// problem within the field, or -1 if it applies to the whole field.
+type ValidationError struct {
+	Field    string
+	Value    string
+	Reason   string
+	Position int
+}
+
+func (e ValidationError) Error() string {
+
+	if e.Position >= 0 {
+		return fmt.Sprintf("Invalid %s '%s': %s (at position %d)", e.Field,
+			e.Value, e.Reason, e.Position)
+	}
+	return fmt.Sprintf("Invalid %s '%s': %s", e.Field, e.Value, e.Reason)
+}
+
+func ReturnValidationError(verr ValidationError, response *[]byte) {
+
+	// Like ReturnError but the details are also sent, as JSON, in Text
+
+	details, _ := json.Marshal(verr)
+	errtext := Reply{0, string(details), ERROR, verr.Error()}
+	logit(verr.Error())
+	jsondata, _ := json.Marshal(errtext)
+	*response = jsondata
+}
+
+func ValidateRegex(postdata PostedData) *ValidationError {
+
+	// Check the posted regex can be saved
+
+	name := postdata.Name
+	if len(name) == 0 {
+		return &ValidationError{"Name", name, "must be set", -1}
+	}
+	if len(name) > MaxNameLength {
+		return &ValidationError{"Name", name,
+			fmt.Sprintf("must be at most %d characters", MaxNameLength), -1}
+	}
+	if pos := strings.IndexFunc(name, unicode.IsSpace); pos >= 0 {
+		return &ValidationError{"Name", name, "must not contain spaces", pos}
+	}
+
+	matchtype := postdata.MatchType
+	if len(matchtype) == 0 {
+		matchtype = MatchPcre
+	}
+	switch matchtype {
+	case MatchPcre, MatchGlob, MatchList, MatchCidr:
+	default:
+		return &ValidationError{"MatchType", matchtype, "must be one of '" +
+			strings.Join([]string{MatchPcre, MatchGlob, MatchList, MatchCidr},
+				"', '") + "'", -1}
+	}
+
+	expr := postdata.Regex
+	if len(expr) == 0 {
+		return &ValidationError{"Regex", expr, "must be set", -1}
+	}
+	if len(expr) > MaxRegexLength {
+		return &ValidationError{"Regex", expr,
+			fmt.Sprintf("must be at most %d characters", MaxRegexLength), -1}
+	}
+	if matchtype == MatchGlob {
+		if pos := strings.IndexFunc(expr, unicode.IsSpace); pos >= 0 {
+			return &ValidationError{"Regex", expr, "must not contain spaces", pos}
+		}
+	}
+	if matchtype == MatchList {
+		for _, saltid := range SplitList(expr) {
+			if strings.IndexFunc(saltid, unicode.IsSpace) >= 0 {
+				return &ValidationError{"Regex", expr,
+					"salt ids must not contain spaces", strings.Index(expr, saltid)}
+			}
+		}
+	}
+	if _, err := MatchRegexp(Regex{Regex: expr, MatchType: matchtype}); err != nil {
+		if serr, ok := err.(*syntax.Error); ok && matchtype == MatchPcre {
+			return &ValidationError{"Regex", expr,
+				serr.Code.String() + ": `" + serr.Expr + "`",
+				strings.Index(expr, serr.Expr)}
+		}
+		return &ValidationError{"Regex", expr, err.Error(), -1}
+	}
+
+	rule := postdata.Rule
+	if len(rule) > 0 && rule != RuleInclude && rule != RuleExclude {
+		return &ValidationError{"Rule", rule,
+			"must be '" + RuleInclude + "' or '" + RuleExclude + "'", -1}
+	}
+
+	return nil
+}
+
+// ***************************************************************************
+// CLASSES
+// ***************************************************************************
+
+func ParseClass(class string) (RegexSlsMap, error) {
+
+	// Split a class into its formula and the dotted path of the state file
+	// within the formula, e.g. 'apache.mods.ssl' is formula 'apache' and
+	// state file 'mods.ssl'. A trailing '.init' is dropped since Salt treats
+	// 'apache.init' and 'apache' as the same state.
+
+	regexmap := RegexSlsMap{}
+
+	if len(strings.TrimSpace(class)) == 0 {
+		return regexmap, ApiError{"Invalid class '" + class +
+			"': a class must not be empty"}
+	}
+
+	parts := strings.Split(class, ".")
+	for _, part := range parts {
+		if len(part) == 0 {
+			return regexmap, ApiError{"Invalid class '" + class +
+				"': names between dots must not be empty"}
+		}
+		if strings.IndexFunc(part, unicode.IsSpace) >= 0 {
+			return regexmap, ApiError{"Invalid class '" + class +
+				"': must not contain spaces"}
+		}
+	}
+
+	if len(parts) > 1 && parts[len(parts)-1] == "init" {
+		parts = parts[:len(parts)-1]
+	}
+
+	regexmap.Formula = parts[0]
+	regexmap.StateFile = strings.Join(parts[1:], ".")
+
+	return regexmap, nil
+}
+
+func (m RegexSlsMap) Class() string {
+
+	// The class name as written in a top file, formula or formula.statefile
+
+	if len(m.StateFile) > 0 {
+		return m.Formula + "." + m.StateFile
+	}
+	return m.Formula
+}
+
+// A placeholder in a class, e.g. the {role} in app.{role}, filled from the
+// regex's named capture group of the same name
+var placeholder = regexp.MustCompile(`\{(\w+)\}`)
+
+func CheckPlaceholders(class string, re *regexp.Regexp) error {
+
+	// Check that every placeholder in class names a capture group of re and
+	// that there are no stray braces. re is nil for cidr matches, which
+	// have no groups.
+
+	for _, m := range placeholder.FindAllStringSubmatch(class, -1) {
+		if re == nil || re.SubexpIndex(m[1]) < 0 {
+			return ApiError{"Invalid class '" + class + "': the regex has no " +
+				"capture group named '" + m[1] + "'"}
+		}
+	}
+
+	if strings.ContainsAny(placeholder.ReplaceAllString(class, ""), "{}") {
+		return ApiError{"Invalid class '" + class + "': placeholders must " +
+			"look like {name}"}
+	}
+
+	return nil
+}
+
+// ***************************************************************************
+// AUDIT
+// ***************************************************************************
+
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+const (
+	AuditRegex   = "regex"
+	AuditClasses = "classes"
+)
+
+func WriteAudit(tx *gorm.DB, audit Audit, before, after interface{}) error {
+
+	// Save an audit record with tx, the transaction making the change, so
+	// the change and its record are saved together or not at all. before
+	// and after are stored as JSON, nil meaning there was nothing.
+
+	audit.Time = time.Now().UTC()
+
+	if before != nil {
+		b, err := json.Marshal(before)
+		if err != nil {
+			return err
+		}
+		audit.Before = string(b)
+	}
+
+	if after != nil {
+		a, err := json.Marshal(after)
+		if err != nil {
+			return err
+		}
+		audit.After = string(a)
+	}
+
+	return tx.Create(&audit).Error
+}
+
+func NextRegexId(tx *gorm.DB) (int64, error) {
+
+	// Return an Id that no regex has had before. SQLite hands out the
+	// highest rowid again once that row is deleted, which would give a new
+	// regex the old one's orphaned classes and audit history, so Ids still
+	// used in the regex_sls_maps or audits tables are skipped too. The
+	// caller must hold the lock.
+
+	var id int64
+	if err := tx.Raw("select coalesce(max(id), 0) from (" +
+		"select max(id) as id from regexes union " +
+		"select max(regex_id) from regex_sls_maps union " +
+		"select max(regex_id) from audits)").Row().Scan(&id); err != nil {
+		return 0, err
+	}
+
+	return id + 1, nil
+}
+
+// ***************************************************************************
+// REVISIONS
+// ***************************************************************************
+
+// A regex and its classes as kept in a revision
+type SnapshotRegex struct {
+	Regex   Regex
+	Classes []string
+}
+
+func Snapshot(db *gorm.DB, dc, env string) ([]SnapshotRegex, error) {
+
+	// Return the regexes in dc and env, in precedence order, with their
+	// classes. It doesn't lock so that it can be used in a transaction; the
+	// caller must hold the lock.
+
+	snapshot := []SnapshotRegex{}
+
+	regexes := []Regex{}
+	if err := db.Order("priority desc, id").Find(&regexes, "dc = ? and env = ?",
+		dc, env); err.Error != nil {
+		if !err.RecordNotFound() {
+			return snapshot, err.Error
+		}
+	}
+
+	ids := []int64{}
+	for i := range regexes {
+		ids = append(ids, regexes[i].Id)
+	}
+
+	maps := []RegexSlsMap{}
+	if len(ids) > 0 {
+		if err := db.Order("id").Where("regex_id in (?)", ids).Find(
+			&maps); err.Error != nil {
+			if !err.RecordNotFound() {
+				return snapshot, err.Error
+			}
+		}
+	}
+
+	classes := make(map[int64][]string)
+	for _, m := range maps {
+		// Older versions saved blank classes, which give no state
+		if len(strings.TrimSpace(m.Class())) == 0 {
+			continue
+		}
+		classes[m.RegexId] = append(classes[m.RegexId], m.Class())
+	}
+
+	for i := range regexes {
+		snapshotregex := SnapshotRegex{regexes[i], classes[regexes[i].Id]}
+		if snapshotregex.Classes == nil {
+			snapshotregex.Classes = []string{}
+		}
+		snapshot = append(snapshot, snapshotregex)
+	}
+
+	return snapshot, nil
+}
+
+func LatestRevision(db *gorm.DB, dc, env string) (int64, error) {
+
+	// Return the newest revision number in dc and env, or 0 if there are
+	// none. The caller must hold the lock.
+
+	revisions := []Revision{}
+	if err := db.Order("number desc").Limit(1).Find(&revisions,
+		"dc = ? and env = ?", dc, env); err.Error != nil {
+		if !err.RecordNotFound() {
+			return 0, err.Error
+		}
+	}
+
+	if len(revisions) == 0 {
+		return 0, nil
+	}
+
+	return revisions[0].Number, nil
+}
+
+func WriteRevision(tx *gorm.DB, audit Audit, reason string) error {
+
+	// Save the regexes and classes in the audit record's environment, as
+	// they are in tx, as the next revision
+
+	number, err := LatestRevision(tx, audit.Dc, audit.Env)
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := Snapshot(tx, audit.Dc, audit.Env)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	revision := Revision{
+		Dc:       audit.Dc,
+		Env:      audit.Env,
+		Number:   number + 1,
+		Login:    audit.Login,
+		Time:     time.Now().UTC(),
+		Reason:   reason,
+		Snapshot: string(data),
+	}
+
+	return tx.Create(&revision).Error
+}
+
+func FirstRevision(tx *gorm.DB, audit Audit) error {
+
+	// Environments changed before revisions were kept have none, so save
+	// them as they are as the first revision. This must be called before tx
+	// changes anything.
+
+	number, err := LatestRevision(tx, audit.Dc, audit.Env)
+	if err != nil || number > 0 {
+		return err
+	}
+
+	return WriteRevision(tx, audit, "Configuration before revisions were kept")
+}
+
+func SameClasses(a, b []string) bool {
+
+	// Return whether two lists hold the same classes, in any order
+
+	if len(a) != len(b) {
+		return false
+	}
+
+	x := append([]string{}, a...)
+	y := append([]string{}, b...)
+	sort.Strings(x)
+	sort.Strings(y)
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func ApplyRegexes(tx *gorm.DB, audit Audit, current,
+	wanted []SnapshotRegex) error {
+
+	// Change the regexes in the audit record's environment from current to
+	// wanted, writing an audit record for each change. A wanted regex with
+	// the Id of a current one updates it, the others are created, and
+	// current regexes that aren't wanted are deleted. The caller must hold
+	// the lock.
+
+	byid := make(map[int64]SnapshotRegex)
+	for _, c := range current {
+		byid[c.Regex.Id] = c
+	}
+
+	kept := make(map[int64]bool)
+	for _, w := range wanted {
+		regex := w.Regex
+		regex.Dc = audit.Dc
+		regex.Env = audit.Env
+		audit.RegexId = regex.Id
+
+		old, found := byid[regex.Id]
+		if !found || kept[regex.Id] {
+			var err error
+			if regex.Id, err = NextRegexId(tx); err != nil {
+				return err
+			}
+			if err := tx.Create(&regex).Error; err != nil {
+				return err
+			}
+			audit.Action = AuditCreate
+			audit.Kind = AuditRegex
+			audit.RegexId = regex.Id
+			if err := WriteAudit(tx, audit, nil, regex); err != nil {
+				return err
+			}
+			old = SnapshotRegex{Classes: []string{}}
+		} else if regex != old.Regex {
+			if err := tx.Save(&regex).Error; err != nil {
+				return err
+			}
+			audit.Action = AuditUpdate
+			audit.Kind = AuditRegex
+			if err := WriteAudit(tx, audit, old.Regex, regex); err != nil {
+				return err
+			}
+		}
+		kept[regex.Id] = true
+
+		if SameClasses(old.Classes, w.Classes) {
+			continue
+		}
+		if err := tx.Where("regex_id = ?", regex.Id).Delete(
+			RegexSlsMap{}).Error; err != nil {
+			return err
+		}
+		for _, class := range w.Classes {
+			if len(strings.TrimSpace(class)) == 0 {
+				// A blank class from an older version's revision
+				continue
+			}
+			regexmap, err := ParseClass(class)
+			if err != nil {
+				return err
+			}
+			regexmap.RegexId = regex.Id
+			if err := tx.Create(&regexmap).Error; err != nil {
+				return err
+			}
+		}
+		audit.Action = AuditUpdate
+		audit.Kind = AuditClasses
+		if err := WriteAudit(tx, audit, old.Classes, w.Classes); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range current {
+		if kept[c.Regex.Id] {
+			continue
+		}
+		audit.Action = AuditDelete
+		audit.RegexId = c.Regex.Id
+		if err := tx.Where("regex_id = ?", c.Regex.Id).Delete(
+			RegexSlsMap{}).Error; err != nil {
+			return err
+		}
+		if len(c.Classes) > 0 {
+			audit.Kind = AuditClasses
+			if err := WriteAudit(tx, audit, c.Classes, nil); err != nil {
+				return err
+			}
+		}
+		regex := c.Regex
+		if err := tx.Delete(&regex).Error; err != nil {
+			return err
+		}
+		audit.Kind = AuditRegex
+		if err := WriteAudit(tx, audit, c.Regex, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ***************************************************************************
+// DIFF
+// ***************************************************************************
+
+// A field that differs between two versions of a regex
+type FieldDiff struct {
+	Field  string
+	Before interface{}
+	After  interface{}
+}
+
+// How a regex differs between two configurations
+type RegexDiff struct {
+	Name           string
+	Fields         []FieldDiff
+	AddedClasses   []string
+	RemovedClasses []string
+}
+
+type Diff struct {
+	Added   []SnapshotRegex // Regexes only in the second configuration
+	Removed []SnapshotRegex // Regexes only in the first configuration
+	Changed []RegexDiff
+}
+
+func DiffRegex(before, after SnapshotRegex) RegexDiff {
+
+	// Compare two versions of a regex, ignoring where they are kept
+
+	b := before.Regex
+	a := after.Regex
+	for _, regex := range []*Regex{&b, &a} {
+		if len(regex.Rule) == 0 {
+			regex.Rule = RuleInclude
+		}
+		if len(regex.MatchType) == 0 {
+			regex.MatchType = MatchPcre
+		}
+	}
+
+	diff := RegexDiff{
+		Name:           a.Name,
+		Fields:         []FieldDiff{},
+		AddedClasses:   []string{},
+		RemovedClasses: []string{},
+	}
+
+	fields := []FieldDiff{
+		{"Regex", b.Regex, a.Regex},
+		{"Desc", b.Desc, a.Desc},
+		{"Priority", b.Priority, a.Priority},
+		{"Rule", b.Rule, a.Rule},
+		{"MatchType", b.MatchType, a.MatchType},
+		{"IgnoreCase", b.IgnoreCase, a.IgnoreCase},
+		{"FullMatch", b.FullMatch, a.FullMatch},
+	}
+	for _, field := range fields {
+		if field.Before != field.After {
+			diff.Fields = append(diff.Fields, field)
+		}
+	}
+
+	had := make(map[string]bool)
+	for _, class := range before.Classes {
+		had[class] = true
+	}
+	has := make(map[string]bool)
+	for _, class := range after.Classes {
+		has[class] = true
+		if !had[class] {
+			diff.AddedClasses = append(diff.AddedClasses, class)
+		}
+	}
+	for _, class := range before.Classes {
+		if !has[class] {
+			diff.RemovedClasses = append(diff.RemovedClasses, class)
+		}
+	}
+
+	return diff
+}
+
+func DiffSnapshots(from, to []SnapshotRegex) Diff {
+
+	// Compare two configurations by regex Name. Regexes sharing a Name are
+	// paired up in precedence order.
+
+	diff := Diff{
+		Added:   []SnapshotRegex{},
+		Removed: []SnapshotRegex{},
+		Changed: []RegexDiff{},
+	}
+
+	byname := make(map[string][]int) // Indexes in from
+	for i := range from {
+		name := from[i].Regex.Name
+		byname[name] = append(byname[name], i)
+	}
+
+	paired := make([]bool, len(from))
+	for _, after := range to {
+		name := after.Regex.Name
+		if len(byname[name]) == 0 {
+			diff.Added = append(diff.Added, after)
+			continue
+		}
+		i := byname[name][0]
+		byname[name] = byname[name][1:]
+		paired[i] = true
+		regexdiff := DiffRegex(from[i], after)
+		if len(regexdiff.Fields) > 0 || len(regexdiff.AddedClasses) > 0 ||
+			len(regexdiff.RemovedClasses) > 0 {
+			diff.Changed = append(diff.Changed, regexdiff)
+		}
+	}
+
+	for i := range from {
+		if !paired[i] {
+			diff.Removed = append(diff.Removed, from[i])
+		}
+	}
+
+	return diff
+}
+
+func DuplicateNames(snapshot []SnapshotRegex) []string {
+
+	// Return the names used by more than one regex. Regexes are matched by
+	// name, so these can't be paired up reliably.
+
+	count := make(map[string]int)
+	names := []string{}
+	for _, s := range snapshot {
+		count[s.Regex.Name]++
+		if count[s.Regex.Name] == 2 {
+			names = append(names, s.Regex.Name)
+		}
+	}
+
+	return names
+}
+
+// ***************************************************************************
+// FILE FORMATS
+// ***************************************************************************
+
+const (
+	FormatJson = "json"
+	FormatYaml = "yaml"
+	FormatCsv  = "csv"
+)
+
+// A regex and its classes as written to an export file. The YAML keys
+// are the same as the JSON ones.
+type FileRegex struct {
+	Name       string   `yaml:"Name"`
+	Desc       string   `yaml:"Desc"`
+	Regex      string   `yaml:"Regex"`
+	MatchType  string   `yaml:"MatchType"`
+	Rule       string   `yaml:"Rule"`
+	Priority   int64    `yaml:"Priority"`
+	IgnoreCase bool     `yaml:"IgnoreCase"`
+	FullMatch  bool     `yaml:"FullMatch"`
+	Classes    []string `yaml:"Classes"`
+}
+
+// The columns of a CSV export. Classes are separated by spaces.
+var CsvHeader = []string{"Name", "Desc", "Regex", "MatchType", "Rule",
+	"Priority", "IgnoreCase", "FullMatch", "Classes"}
+
+func CheckFormat(format string) error {
+
+	switch format {
+	case FormatJson, FormatYaml, FormatCsv:
+		return nil
+	}
+	return ApiError{"'format' must be one of '" + strings.Join(
+		[]string{FormatJson, FormatYaml, FormatCsv}, "', '") + "'"}
+}
+
+func ToFile(snapshot []SnapshotRegex) []FileRegex {
+
+	// Return the regexes without the fields that only make sense in this
+	// database
+
+	regexes := []FileRegex{}
+	for _, s := range snapshot {
+		regexes = append(regexes, FileRegex{
+			Name:       s.Regex.Name,
+			Desc:       s.Regex.Desc,
+			Regex:      s.Regex.Regex,
+			MatchType:  s.Regex.MatchType,
+			Rule:       s.Regex.Rule,
+			Priority:   s.Regex.Priority,
+			IgnoreCase: s.Regex.IgnoreCase,
+			FullMatch:  s.Regex.FullMatch,
+			Classes:    s.Classes,
+		})
+	}
+
+	return regexes
+}
+
+func Encode(regexes []FileRegex, format string) ([]byte, error) {
+
+	switch format {
+	case FormatYaml:
+		return yaml.Marshal(regexes)
+	case FormatCsv:
+		buf := bytes.Buffer{}
+		w := csv.NewWriter(&buf)
+		w.Write(CsvHeader)
+		for _, r := range regexes {
+			w.Write([]string{
+				r.Name,
+				r.Desc,
+				r.Regex,
+				r.MatchType,
+				r.Rule,
+				strconv.FormatInt(r.Priority, 10),
+				strconv.FormatBool(r.IgnoreCase),
+				strconv.FormatBool(r.FullMatch),
+				strings.Join(r.Classes, " "),
+			})
+		}
+		w.Flush()
+		return buf.Bytes(), w.Error()
+	}
+
+	return json.MarshalIndent(regexes, "", "  ")
+}
+
+func Decode(data []byte, format string) ([]FileRegex, error) {
+
+	// Read the regexes from a file written by Encode
+
+	regexes := []FileRegex{}
+
+	switch format {
+	case FormatYaml:
+		// Strict, so a misspelt key is an error rather than a default
+		if err := yaml.UnmarshalStrict(data, &regexes); err != nil {
+			return regexes, ApiError{"Error decoding YAML (" + err.Error() + ")."}
+		}
+	case FormatCsv:
+		rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+		if err != nil {
+			return regexes, ApiError{"Error decoding CSV (" + err.Error() + ")."}
+		}
+		if len(rows) == 0 || strings.Join(rows[0], ",") !=
+			strings.Join(CsvHeader, ",") {
+			return regexes, ApiError{"The first CSV row must be '" +
+				strings.Join(CsvHeader, ",") + "'"}
+		}
+		for i, row := range rows[1:] {
+			line := strconv.Itoa(i + 2)
+			r := FileRegex{
+				Name:      row[0],
+				Desc:      row[1],
+				Regex:     row[2],
+				MatchType: row[3],
+				Rule:      row[4],
+				Classes:   strings.Fields(row[8]),
+			}
+			if len(row[5]) > 0 {
+				if r.Priority, err = strconv.ParseInt(row[5], 10, 64); err != nil {
+					return regexes, ApiError{"CSV line " + line +
+						": Priority must be a number"}
+				}
+			}
+			if len(row[6]) > 0 {
+				if r.IgnoreCase, err = strconv.ParseBool(row[6]); err != nil {
+					return regexes, ApiError{"CSV line " + line +
+						": IgnoreCase must be true or false"}
+				}
+			}
+			if len(row[7]) > 0 {
+				if r.FullMatch, err = strconv.ParseBool(row[7]); err != nil {
+					return regexes, ApiError{"CSV line " + line +
+						": FullMatch must be true or false"}
+				}
+			}
+			regexes = append(regexes, r)
+		}
+	default:
+		// Strict like YAML, and only one document
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&regexes); err != nil {
+			return regexes, ApiError{"Error decoding JSON (" + err.Error() + ")."}
+		}
+		if _, err := decoder.Token(); err != io.EOF {
+			return regexes, ApiError{"Error decoding JSON (data after the " +
+				"list of regexes)."}
+		}
+	}
+
+	return regexes, nil
+}
+
+func CheckFile(regexes []FileRegex) ([]SnapshotRegex, error) {
+
+	// Validate every regex and class in an imported file, the same way as
+	// the regexes and regex_sls_maps endpoints do, and return them ready to
+	// save. Names must be unique since they say which regex to update.
+
+	snapshot := []SnapshotRegex{}
+	names := make(map[string]bool)
+
+	for i, r := range regexes {
+		where := "Regex " + strconv.Itoa(i+1) + ": "
+
+		if verr := ValidateRegex(PostedData{
+			Desc:       r.Desc,
+			Name:       r.Name,
+			Regex:      r.Regex,
+			Priority:   r.Priority,
+			Rule:       r.Rule,
+			MatchType:  r.MatchType,
+			IgnoreCase: r.IgnoreCase,
+			FullMatch:  r.FullMatch,
+		}); verr != nil {
+			return snapshot, ApiError{where + verr.Error()}
+		}
+		if names[r.Name] {
+			return snapshot, ApiError{where + "Name '" + r.Name +
+				"' is used more than once"}
+		}
+		names[r.Name] = true
+
+		regex := Regex{
+			Regex:      r.Regex,
+			Name:       r.Name,
+			Desc:       r.Desc,
+			Priority:   r.Priority,
+			Rule:       r.Rule,
+			MatchType:  r.MatchType,
+			IgnoreCase: r.IgnoreCase,
+			FullMatch:  r.FullMatch,
+		}
+		if len(regex.Rule) == 0 {
+			regex.Rule = RuleInclude
+		}
+		if len(regex.MatchType) == 0 {
+			regex.MatchType = MatchPcre
+		}
+
+		re, err := MatchRegexp(regex)
+		if err != nil {
+			return snapshot, ApiError{where + err.Error()}
+		}
+
+		classes := []string{}
+		seen := make(map[string]bool)
+		for _, class := range r.Classes {
+			regexmap, err := ParseClass(class)
+			if err != nil {
+				return snapshot, ApiError{where + err.Error()}
+			}
+			class = regexmap.Class()
+			if err := CheckPlaceholders(class, re); err != nil {
+				return snapshot, ApiError{where + err.Error()}
+			}
+			if !seen[class] {
+				seen[class] = true
+				classes = append(classes, class)
+			}
+		}
+
+		snapshot = append(snapshot, SnapshotRegex{regex, classes})
+	}
+
+	return snapshot, nil
+}
+
+func MatchByName(target, source []SnapshotRegex,
+	merge bool) []SnapshotRegex {
+
+	// Return the configuration wanted in the target environment: the source
+	// regexes, each taking the Id of a target regex with the same Name so
+	// that the target regex is changed rather than replaced. Regexes sharing
+	// a Name are paired up in precedence order. When merging, target
+	// regexes with no source regex of the same Name are kept too.
+
+	byname := make(map[string][]int) // Indexes in target
+	for i := range target {
+		name := target[i].Regex.Name
+		byname[name] = append(byname[name], i)
+	}
+
+	wanted := []SnapshotRegex{}
+	paired := make([]bool, len(target))
+	for _, s := range source {
+		w := SnapshotRegex{s.Regex, append([]string{}, s.Classes...)}
+		w.Regex.Id = 0
+		if ids := byname[s.Regex.Name]; len(ids) > 0 {
+			byname[s.Regex.Name] = ids[1:]
+			paired[ids[0]] = true
+			w.Regex.Id = target[ids[0]].Regex.Id
+		}
+		wanted = append(wanted, w)
+	}
+
+	if merge {
+		for i := range target {
+			if !paired[i] {
+				wanted = append(wanted, target[i])
+			}
+		}
+	}
+
+	return wanted
+}
+
+// ***************************************************************************
+// CLASSIFICATION
+// ***************************************************************************
+
+func LoadRegexes(db *gorm.DB, dc, env string) ([]Regex, error) {
+
+	// Return all regexes for an environment in precedence order, highest
+	// priority first. Regexes with the same priority are in the order they
+	// were added. The caller must hold the lock.
+
+	regexes := []Regex{}
+	if err := db.Order("priority desc, id").Find(&regexes,
+		"dc = ? and env = ?", dc, env); err.Error != nil {
+		if !err.RecordNotFound() {
+			return regexes, err.Error
+		}
+	}
+
+	return regexes, nil
+}
+
+func LoadMaps(db *gorm.DB, regexes []Regex) (map[int64][]RegexSlsMap, error) {
+
+	// Return the RegexSlsMaps for each regex, keyed by RegexId. The caller
+	// must hold the lock.
+
+	maps := make(map[int64][]RegexSlsMap)
+	if len(regexes) == 0 {
+		return maps, nil
+	}
+
+	ids := []int64{}
+	for i := range regexes {
+		ids = append(ids, regexes[i].Id)
+	}
+
+	rows := []RegexSlsMap{}
+	if err := db.Order("id").Find(&rows, "regex_id in (?)", ids); err.Error != nil {
+		if !err.RecordNotFound() {
+			return maps, err.Error
+		}
+	}
+
+	for i := range rows {
+		maps[rows[i].RegexId] = append(maps[rows[i].RegexId], rows[i])
+	}
+
+	return maps, nil
+}
+
+// A regex compiled and ready to be tested against salt ids
+type Matcher struct {
+	Regex   Regex
+	Classes []string // Classes from the regex's RegexSlsMaps
+	Error   string   // Why the regex can't be used, empty if it can
+	re      *regexp.Regexp
+	nets    []*net.IPNet // Networks for cidr matches
+}
+
+func NewMatchers(regexes []Regex,
+	maps map[int64][]RegexSlsMap) []Matcher {
+
+	// Compile each regex and gather its classes. The order of regexes is
+	// kept. Regexes saved before they were validated may not compile. They
+	// are logged and kept with their Error set, so they can be reported,
+	// but never match.
+
+	matchers := []Matcher{}
+
+	for i := range regexes {
+		re, err := MatchRegexp(regexes[i])
+		matcher := Matcher{
+			Regex:   regexes[i],
+			Classes: []string{},
+			re:      re,
+		}
+		if err != nil {
+			txt := fmt.Sprintf("Regex '%s' (Id:%d) does not compile: %s",
+				regexes[i].Name, regexes[i].Id, err.Error())
+			logit(txt)
+			matcher.Error = err.Error()
+		}
+		if len(matcher.Regex.Rule) == 0 {
+			matcher.Regex.Rule = RuleInclude
+		}
+		if len(matcher.Regex.MatchType) == 0 {
+			matcher.Regex.MatchType = MatchPcre
+		}
+		if matcher.Regex.MatchType == MatchCidr {
+			matcher.nets, _ = ParseNets(regexes[i].Regex)
+		}
+		for _, m := range maps[regexes[i].Id] {
+			if class := m.Class(); len(class) > 0 {
+				matcher.Classes = append(matcher.Classes, class)
+			}
+		}
+		matchers = append(matchers, matcher)
+	}
+
+	return matchers
+}
+
+func LoadMatchers(db *gorm.DB, dc, env string) ([]Matcher, error) {
+
+	// Return matchers for all regexes in dc and env, in precedence order.
+	// The caller must hold the lock.
+
+	regexes, err := LoadRegexes(db, dc, env)
+	if err != nil {
+		return []Matcher{}, err
+	}
+
+	maps, err := LoadMaps(db, regexes)
+	if err != nil {
+		return []Matcher{}, err
+	}
+
+	return NewMatchers(regexes, maps), nil
+}
+
+func (m Matcher) Match(saltid, addr string) []int {
+
+	// Return the start and end offsets of the match in saltid, or nil if
+	// there is no match. Cidr matches test addr, the host's address if
+	// known, and give an empty span. Regexes that don't compile never
+	// match.
+
+	if len(m.Error) > 0 {
+		return nil
+	}
+
+	if m.Regex.MatchType == MatchCidr {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil
+		}
+		for _, ipnet := range m.nets {
+			if ipnet.Contains(ip) {
+				return []int{0, 0}
+			}
+		}
+		return nil
+	}
+
+	return m.re.FindStringIndex(saltid)
+}
+
+func (m Matcher) Expand(saltid string) []string {
+
+	// Return the matcher's classes for saltid with any placeholders filled
+	// in. A class is left out if one of its groups took no part in the
+	// match.
+
+	classes := []string{}
+
+	if m.re == nil {
+		// Cidr matches have no capture groups
+		for _, class := range m.Classes {
+			if !placeholder.MatchString(class) {
+				classes = append(classes, class)
+			}
+		}
+		return classes
+	}
+
+	match := m.re.FindStringSubmatchIndex(saltid)
+	if match == nil {
+		return classes
+	}
+
+	for _, class := range m.Classes {
+		ok := true
+		expanded := placeholder.ReplaceAllStringFunc(class, func(s string) string {
+			i := m.re.SubexpIndex(s[1 : len(s)-1])
+			if i < 0 || match[2*i] < 0 || match[2*i] == match[2*i+1] {
+				ok = false
+				return s
+			}
+			return saltid[match[2*i]:match[2*i+1]]
+		})
+		if ok {
+			classes = append(classes, expanded)
+		}
+	}
+
+	return classes
+}
+
+// The outcome of testing one regex against a salt id
+type RegexResult struct {
+	RegexId   int64
+	Name      string
+	Regex     string
+	MatchType string
+	Priority  int64
+	Rule      string
+	Matched   bool
+	Span      []int    // Start and end offsets of the match in the salt id
+	Classes   []string // Classes the regex included or excluded
+	Ignored   []string // Classes already decided by a higher priority regex
+	Untested  bool     // A cidr match with no address to test against
+	Error     string   // Why the regex was skipped, if it doesn't compile
+}
+
+func Evaluate(matchers []Matcher, saltid, addr string) ([]RegexResult,
+	[]string) {
+
+	// Test every matcher against saltid, and addr for cidr matches, in
+	// precedence order, and return the result for each regex along with the
+	// final list of classes.
+	//
+	// The first matching regex to mention a class decides it: an include
+	// rule adds the class and an exclude rule removes it. Lower priority
+	// regexes mentioning the same class are ignored for that class.
+	//
+	// Cidr regexes can't be tested without an address. They are marked
+	// Untested and list the undecided classes they may have included or
+	// excluded, which are left undecided. Regexes that don't compile are
+	// skipped and their result has the Error.
+
+	results := []RegexResult{}
+	classes := []string{}
+
+	decided := make(map[string]bool)
+	for i := range matchers {
+		regex := matchers[i].Regex
+		result := RegexResult{
+			RegexId:   regex.Id,
+			Name:      regex.Name,
+			Regex:     regex.Regex,
+			MatchType: regex.MatchType,
+			Priority:  regex.Priority,
+			Rule:      regex.Rule,
+			Classes:   []string{},
+			Ignored:   []string{},
+		}
+		if len(matchers[i].Error) > 0 {
+			result.Error = matchers[i].Error
+		} else if regex.MatchType == MatchCidr && net.ParseIP(addr) == nil {
+			result.Untested = true
+			for _, class := range matchers[i].Expand(saltid) {
+				if !decided[class] {
+					result.Classes = append(result.Classes, class)
+				}
+			}
+		} else if span := matchers[i].Match(saltid, addr); span != nil {
+			result.Matched = true
+			result.Span = span
+			for _, class := range matchers[i].Expand(saltid) {
+				if decided[class] {
+					result.Ignored = append(result.Ignored, class)
+					continue
+				}
+				decided[class] = true
+				result.Classes = append(result.Classes, class)
+				if result.Rule == RuleInclude {
+					classes = append(classes, class)
+				}
+			}
+		}
+		results = append(results, result)
+	}
+
+	return results, classes
+}
+
+func UntestedClasses(results []RegexResult) []string {
+
+	// Return the classes that untested cidr regexes may have included or
+	// excluded
+
+	classes := []string{}
+	for i := range results {
+		if results[i].Untested {
+			classes = append(classes, results[i].Classes...)
+		}
+	}
+
+	return classes
+}
+
+func (o HostOverride) Class() string {
+
+	// Return the override's class name, e.g. mods.ssl
+
+	if len(o.StateFile) == 0 {
+		return o.Formula
+	}
+	return o.Formula + "." + o.StateFile
+}
+
+func LoadOverrides(db *gorm.DB, dc, env string) (map[string][]HostOverride,
+	error) {
+
+	// Return the host overrides in dc and env keyed by salt id. The caller
+	// must hold the lock.
+
+	overrides := []HostOverride{}
+	if err := db.Order("id").Find(&overrides, "dc = ? and env = ?", dc,
+		env); err.Error != nil {
+		if !err.RecordNotFound() {
+			return map[string][]HostOverride{}, err.Error
+		}
+	}
+
+	byhost := make(map[string][]HostOverride)
+	for _, override := range overrides {
+		byhost[override.SaltId] = append(byhost[override.SaltId], override)
+	}
+
+	return byhost, nil
+}
+
+func ApplyOverrides(classes []string, overrides []HostOverride) ([]string,
+	[]string, []string) {
+
+	// Merge one salt id's overrides into the classes decided by the regexes.
+	// Overrides always win over the regexes. Returns the final classes, the
+	// classes added by overrides and the classes removed by overrides.
+
+	remove := make(map[string]bool)
+	for _, override := range overrides {
+		if override.Action == ActionRemove {
+			remove[override.Class()] = true
+		}
+	}
+
+	final := []string{}
+	added := []string{}
+	removed := []string{}
+
+	have := make(map[string]bool)
+	for _, class := range classes {
+		if remove[class] {
+			removed = append(removed, class)
+			continue
+		}
+		have[class] = true
+		final = append(final, class)
+	}
+
+	for _, override := range overrides {
+		class := override.Class()
+		if override.Action == ActionAdd && !have[class] {
+			have[class] = true
+			final = append(final, class)
+			added = append(added, class)
+		}
+	}
+
+	return final, added, removed
+}
+
+// ***************************************************************************
+// HOSTS
+// ***************************************************************************
+
+func KnownSaltIds(db *gorm.DB, dc, env string, extra []string) ([]string, error) {
+
+	// Return the sorted list of salt ids known in dc and env, including
+	// hosts with overrides, plus any extra ones passed in by the caller.
+	// The caller must hold the lock.
+
+	saltids := []string{}
+	if err := db.Model(Enc{}).Where("dc = ? and env = ?", dc,
+		env).Pluck("distinct salt_id", &saltids); err.Error != nil {
+		if !err.RecordNotFound() {
+			return saltids, err.Error
+		}
+	}
+	overridden := []string{}
+	if err := db.Model(HostOverride{}).Where("dc = ? and env = ?", dc,
+		env).Pluck("distinct salt_id", &overridden); err.Error != nil {
+		if !err.RecordNotFound() {
+			return saltids, err.Error
+		}
+	}
+
+	seen := make(map[string]bool)
+	hosts := []string{}
+	saltids = append(saltids, overridden...)
+	for _, saltid := range append(saltids, extra...) {
+		if len(saltid) == 0 || seen[saltid] {
+			continue
+		}
+		seen[saltid] = true
+		hosts = append(hosts, saltid)
+	}
+	sort.Strings(hosts)
+
+	return hosts, nil
+}
+
+// ***************************************************************************
+// ENC TABLE
+// ***************************************************************************
+
+func RebuildEncs(tx *gorm.DB, dc, env string, extra []string) ([]Enc,
+	error) {
+
+	// Work out the classes for every known salt id in dc and env and
+	// replace the environment's Enc rows with them, one row per class. A
+	// salt id that gets no classes keeps a single row with an empty
+	// Formula so that it is still known next time. Salt ids are all the
+	// address we have, so a host's rows are marked Untested when cidr
+	// regexes may have changed its classes.
+	//
+	// Endpoints that change regexes, classes or overrides call this with
+	// tx, the transaction making the change, so the Enc rows are saved with
+	// the change or not at all. The caller must hold the lock.
+
+	encs := []Enc{}
+
+	matchers, err := LoadMatchers(tx, dc, env)
+	if err != nil {
+		return encs, err
+	}
+
+	overrides, err := LoadOverrides(tx, dc, env)
+	if err != nil {
+		return encs, err
+	}
+
+	hosts, err := KnownSaltIds(tx, dc, env, extra)
+	if err != nil {
+		return encs, err
+	}
+
+	for _, saltid := range hosts {
+		results, classes := Evaluate(matchers, saltid, "")
+		classes, _, _ = ApplyOverrides(classes, overrides[saltid])
+		untested := len(UntestedClasses(results)) > 0
+		if len(classes) == 0 {
+			encs = append(encs, Enc{SaltId: saltid, Dc: dc, Env: env,
+				Untested: untested})
+			continue
+		}
+		for _, class := range classes {
+			parts := strings.SplitN(class, ".", 2)
+			enc := Enc{SaltId: saltid, Formula: parts[0], Dc: dc, Env: env,
+				Untested: untested}
+			if len(parts) == 2 {
+				enc.StateFile = parts[1]
+			}
+			encs = append(encs, enc)
+		}
+	}
+
+	if err := tx.Where("dc = ? and env = ?", dc, env).Delete(
+		Enc{}).Error; err != nil {
+		return encs, err
+	}
+	for i := range encs {
+		if err := tx.Create(&encs[i]).Error; err != nil {
+			return encs, err
+		}
+	}
+
+	return encs, nil
+}
+
+// ***************************************************************************
+// GO RPC PLUGIN
+// ***************************************************************************
+
+type PostedData struct {
+	Desc       string
+	Id         int64
+	Name       string
+	Regex      string
+	Priority   int64
+	Rule       string
+	MatchType  string
+	IgnoreCase bool
+	FullMatch  bool
+}
+
+type ImportOut struct {
+	DryRun bool
+	Diff   Diff // How the environment changed, or would change
+}
+
+func Unlock() {
+
+	config.Portlock.Unlock()
+}
+
+func Lock() {
+
+	config.Portlock.Lock()
+}
+
+func (t *Plugin) GetRequest(args *Args, response *[]byte) error {
+
+	// Export the regexes of an environment, in precedence order, with
+	// their classes. 'format' is 'json' (the default), 'yaml' or 'csv'.
+
+	if len(args.QueryString["env_id"]) == 0 {
+		ReturnError("'env_id' must be set", response)
+		return nil
+	}
+
+	env_id_str := args.QueryString["env_id"][0]
+
+	format := FormatJson
+	if len(args.QueryString["format"]) > 0 {
+		format = args.QueryString["format"][0]
+	}
+	if err := CheckFormat(format); err != nil {
+		ReturnError(err.Error(), response)
+		return nil
+	}
+
+	// Check if the user is allowed to access the environment
+	var err error
+	var foundenv Env
+	if foundenv, err = t.GetAllowedEnv(args, env_id_str, response); err != nil {
+		// GetAllowedEnv wrote the error
+		return nil
+	}
+
+	dc := foundenv.DcSysName
+	env := foundenv.SysName
+
+	// PluginDatabasePath is required to open our private db
+	if len(args.PathParams["PluginDatabasePath"]) == 0 {
+		ReturnError("Internal Error: 'PluginDatabasePath' must be set", response)
+		return nil
+	}
+
+	config.SetDBPath(args.PathParams["PluginDatabasePath"])
+
+	// Open/Create database
+	var gormInst *GormDB
+	if gormInst, err = NewDB(); err != nil {
+		txt := "GormDB open error for '" + config.DBPath() + "enc.db'. " +
+			err.Error()
+		ReturnError(txt, response)
+		return nil
+	}
+
+	db := gormInst.DB() // shortcut
+
+	Lock()
+	snapshot, err := Snapshot(db, dc, env)
+	Unlock()
+	if err != nil {
+		ReturnError(err.Error(), response)
+		return nil
+	}
+
+	// Output the file as text
+
+	data, err := Encode(ToFile(snapshot), format)
+	if err != nil {
+		ReturnError("Marshal error: "+err.Error(), response)
+		return nil
+	}
+	reply := Reply{0, string(data), SUCCESS, ""}
+	jsondata, err := json.Marshal(reply)
+
+	if err != nil {
+		ReturnError("Marshal error: "+err.Error(), response)
+		return nil
+	}
+
+	*response = jsondata
+
+	return nil
+}
+
+func (t *Plugin) PostRequest(args *Args, response *[]byte) error {
+
+	// Import a file written by GET into the environment. Regexes are
+	// matched by Name: ones already in the environment are updated, others
+	// are created, and regexes not in the file are left alone. Every regex
+	// and class is checked before anything is saved, then all the changes
+	// are saved in one transaction. Setting 'dry_run=1' returns the
+	// differences without saving anything.
+
+	if len(args.QueryString["env_id"]) == 0 {
+		ReturnError("'env_id' must be set", response)
+		return nil
+	}
+
+	env_id_str := args.QueryString["env_id"][0]
+
+	format := FormatJson
+	if len(args.QueryString["format"]) > 0 {
+		format = args.QueryString["format"][0]
+	}
+	if err := CheckFormat(format); err != nil {
+		ReturnError(err.Error(), response)
+		return nil
+	}
+
+	dry_run := false
+	if len(args.QueryString["dry_run"]) > 0 {
+		dry_run = args.QueryString["dry_run"][0] == "1"
+	}
+
+	// Check if the user is allowed to access the environment
+	var err error
+	var foundenv Env
+	if foundenv, err = t.GetAllowedEnv(args, env_id_str, response); err != nil {
+		// GetAllowedEnv wrote the error
+		return nil
+	}
+
+	dc := foundenv.DcSysName
+	env := foundenv.SysName
+
+	// PluginDatabasePath is required to open our private db
+	if len(args.PathParams["PluginDatabasePath"]) == 0 {
+		ReturnError("Internal Error: 'PluginDatabasePath' must be set", response)
+		return nil
+	}
+
+	config.SetDBPath(args.PathParams["PluginDatabasePath"])
+
+	// Open/Create database
+	var gormInst *GormDB
+	if gormInst, err = NewDB(); err != nil {
+		txt := "GormDB open error for '" + config.DBPath() + "enc.db'. " +
+			err.Error()
+		ReturnError(txt, response)
+		return nil
+	}
+
+	// Decode and check the file
+
+	regexes, err := Decode(args.PostData, format)
+	if err != nil {
+		ReturnError(err.Error(), response)
+		return nil
+	}
+
+	imported, err := CheckFile(regexes)
+	if err != nil {
+		ReturnError(err.Error(), response)
+		return nil
+	}
+
+	db := gormInst.DB() // shortcut
+
+	out := ImportOut{DryRun: dry_run}
+
+	audit := Audit{
+		Login: args.PathParams["login"],
+		Dc:    dc,
+		Env:   env,
+	}
+
+	// Work out the changes and, unless it's a dry run, make them along with
+	// their audit records and a new revision in one transaction
+
+	Lock()
+	tx := db.Begin()
+	current, err := Snapshot(tx, dc, env)
+	if err != nil {
+		tx.Rollback()
+		Unlock()
+		ReturnError(err.Error(), response)
+		return nil
+	}
+
+	// Regexes are matched by name so names must be unique
+
+	if names := DuplicateNames(current); len(names) > 0 {
+		tx.Rollback()
+		Unlock()
+		ReturnError("Regex names must be unique to import. Used more than "+
+			"once: "+strings.Join(names, ", "), response)
+		return nil
+	}
+
+	wanted := MatchByName(current, imported, true)
+	out.Diff = DiffSnapshots(current, wanted)
+
+	if dry_run {
+		tx.Rollback()
+		Unlock()
+	} else {
+		if err := FirstRevision(tx, audit); err != nil {
+			tx.Rollback()
+			Unlock()
+			ReturnError("Revision error: "+err.Error(), response)
+			return nil
+		}
+		if err := ApplyRegexes(tx, audit, current, wanted); err != nil {
+			tx.Rollback()
+			Unlock()
+			ReturnError("Import error: "+err.Error(), response)
+			return nil
+		}
+		if err := WriteRevision(tx, audit, "Imported "+
+			strconv.Itoa(len(imported))+" regexes from "+format); err != nil {
+			tx.Rollback()
+			Unlock()
+			ReturnError("Revision error: "+err.Error(), response)
+			return nil
+		}
+		if _, err := RebuildEncs(tx, dc, env, []string{}); err != nil {
+			tx.Rollback()
+			Unlock()
+			ReturnError("Enc rebuild error: "+err.Error(), response)
+			return nil
+		}
+		if err := tx.Commit().Error; err != nil {
+			Unlock()
+			ReturnError("Import error: "+err.Error(), response)
+			return nil
+		}
+		Unlock()
+	}
+
+	// Output as JSON
+
+	TempJsonData, err := json.Marshal(out)
+	if err != nil {
+		ReturnError("Marshal error: "+err.Error(), response)
+		return nil
+	}
+	reply := Reply{0, string(TempJsonData), SUCCESS, ""}
+	jsondata, err := json.Marshal(reply)
+
+	if err != nil {
+		ReturnError("Marshal error: "+err.Error(), response)
+		return nil
+	}
+
+	*response = jsondata
+
+	return nil
+}
+
+func (t *Plugin) HandleRequest(args *Args, response *[]byte) error {
+
+	// All plugins must have this.
+
+	if len(args.QueryType) > 0 {
+		switch args.QueryType {
+		case "GET":
+			t.GetRequest(args, response)
+			return nil
+		case "POST":
+			t.PostRequest(args, response)
+			return nil
+		}
+		ReturnError("Internal error: Invalid HTTP request type for this plugin "+
+			args.QueryType, response)
+		return nil
+	} else {
+		ReturnError("Internal error: HTTP request type was not set", response)
+		return nil
+	}
+}
+
+// ***************************************************************************
+// ENTRY POINT
+// ***************************************************************************
+
+func main() {
+
+	// Sets the global config var
+	NewConfig()
+
+	// Create a lock file to use for synchronisation
+	config.Port = 49993
+	config.Portlock = NewPortLock(config.Port)
+
+	plugin := new(Plugin)
+	rpc.Register(plugin)
+
+	listener, err := net.Listen("tcp", ":"+os.Args[1])
+	if err != nil {
+		txt := fmt.Sprintf("Listen error. %s", err)
+		logit(txt)
+	}
+
+	if conn, err := listener.Accept(); err != nil {
+		txt := fmt.Sprintf("Accept error. %s", err)
+		logit(txt)
+	} else {
+		rpc.ServeConn(conn)
+	}
+}
+
+// vim:ts=2:sw=2
@@ -0,0 +1,643 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	"net"
+	"net/rpc"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ***************************************************************************
+// SQLITE3 PRIVATE DB
+// ***************************************************************************
+
+type Enc struct {
+	Id        int64
+	SaltId    string // Name of the server
+	Formula   string // Directory name
+	StateFile string // Sls file name
+	Dc        string // Data centre name
+	Env       string // Environment name
+	Untested  bool   // Cidr regexes that may give classes were not tested
+}
+
+type Regex struct {
+	Id         int64
+	Regex      string // The regular expression
+	Dc         string // Data centre name
+	Env        string // Environment name
+	Name       string // Short name for the regex, no spaces
+	Desc       string // Description of the regex
+	Priority   int64  // Higher priority regexes take precedence
+	Rule       string // "include" (or empty) adds classes, "exclude" removes
+	MatchType  string // "pcre" (or empty), "glob", "list" or "cidr"
+	IgnoreCase bool   // Match salt ids case insensitively
+	FullMatch  bool   // A pcre regex must match the whole salt id
+}
+
+const (
+	RuleInclude = "include"
+	RuleExclude = "exclude"
+)
+
+type RegexSlsMap struct {
+	Id        int64
+	RegexId   int64  // Not null
+	Formula   string // Not null
+	StateFile string // Can be null, dotted if nested, e.g. mods.ssl
+}
+
+type HostOverride struct {
+	Id        int64
+	SaltId    string // Name of the server
+	Formula   string // Not null
+	StateFile string // Can be null, dotted if nested, e.g. mods.ssl
+	Action    string // "add" or "remove" the class
+	Dc        string // Data centre name
+	Env       string // Environment name
+}
+
+type Audit struct {
+	Id      int64
+	Login   string    // Who made the change
+	Time    time.Time // When the change was saved, in UTC
+	Dc      string    // Data centre name
+	Env     string    // Environment name
+	Action  string    // "create", "update" or "delete"
+	Kind    string    // "regex" or "classes"
+	RegexId int64     // The regex that changed, or whose classes changed
+	Before  string    // JSON of the values before, empty if created
+	After   string    // JSON of the values after, empty if deleted
+}
+
+type Revision struct {
+	Id       int64
+	Dc       string    // Data centre name
+	Env      string    // Environment name
+	Number   int64     // Counts up from 1 in each environment
+	Login    string    // Who made the change
+	Time     time.Time // When the change was saved, in UTC
+	Reason   string    // What changed
+	Snapshot string    // JSON of the regexes and their classes afterwards
+}
+
+// --
+
+var config *Config
+
+type Config struct {
+	Dbname   string
+	Portlock *PortLock
+	Port     int
+}
+
+func (c *Config) DBPath() string {
+
+	return c.Dbname
+}
+
+func (c *Config) SetDBPath(path string) {
+
+	c.Dbname = path
+}
+
+func NewConfig() {
+
+	config = &Config{}
+}
+
+// --
+
+type GormDB struct {
+	db gorm.DB
+}
+
+func (gormInst *GormDB) InitDB() error {
+
+	var err error
+	dbname := config.DBPath()
+
+	gormInst.db, err = gorm.Open("sqlite3", dbname+"enc.db")
+	if err != nil {
+		return ApiError{"Open " + dbname + " failed. " + err.Error()}
+	}
+
+	if err := gormInst.db.AutoMigrate(Enc{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate Enc table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(Regex{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate Regex table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(RegexSlsMap{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate RegexSlsMap table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(HostOverride{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate HostOverride table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(Audit{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate Audit table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(Revision{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate Revision table failed: %s", err)
+		return ApiError{txt}
+	}
+
+	// Unique index is also a constraint, so are forced to be unique
+	gormInst.db.Model(Enc{}).AddIndex("idx_enc_salt_id", "salt_id")
+	gormInst.db.Model(HostOverride{}).AddIndex("idx_host_override_salt_id",
+		"salt_id")
+	gormInst.db.Model(Audit{}).AddIndex("idx_audit_dc_env", "dc", "env")
+	gormInst.db.Model(Revision{}).AddIndex("idx_revision_dc_env", "dc", "env")
+
+	return nil
+}
+
+func (gormInst *GormDB) DB() *gorm.DB {
+
+	return &gormInst.db
+}
+
+func NewDB() (*GormDB, error) {
+
+	gormInst := &GormDB{}
+	if err := gormInst.InitDB(); err != nil {
+		return gormInst, err
+	}
+	return gormInst, nil
+}
+
+// ***************************************************************************
+// PORT LOCKING
+// ***************************************************************************
+
+// PortLock is a locker which locks by binding to a port on the loopback IPv4
+// interface
+type PortLock struct {
+	hostport string
+	ln       net.Listener
+}
+
+func NewPortLock(port int) *PortLock {
+
+	// NewFLock creates new Flock-based lock (unlocked first)
+	return &PortLock{hostport: net.JoinHostPort("127.0.0.1", strconv.Itoa(port))}
+}
+
+func (p *PortLock) Lock() {
+
+	// Lock acquires the lock, blocking
+	t := 50 * time.Millisecond
+	for {
+		if l, err := net.Listen("tcp", p.hostport); err == nil {
+			p.ln = l // thanks to zhangpy
+			return
+		}
+		//log.Printf("spinning lock on %s (%s)", p.hostport, err)
+		time.Sleep(t)
+		//t = time.Duration(
+		//  math.Min( float64(time.Duration(float32(t) * 1.5)), 2000 ))
+	}
+}
+
+func (p *PortLock) Unlock() {
+
+	// Unlock releases the lock
+	if p.ln != nil {
+		p.ln.Close()
+	}
+}
+
+// ***************************************************************************
+// MATCH TYPES
+// ***************************************************************************
+
+const (
+	MatchPcre = "pcre" // A regular expression, the default
+	MatchGlob = "glob" // A shell style glob, e.g. web*
+	MatchList = "list" // A comma separated list of salt ids
+	MatchCidr = "cidr" // Comma separated networks matched against the address
+)
+
+// ***************************************************************************
+// CLASSES
+// ***************************************************************************
+
+func (m RegexSlsMap) Class() string {
+
+	// The class name as written in a top file, formula or formula.statefile
+
+	if len(m.StateFile) > 0 {
+		return m.Formula + "." + m.StateFile
+	}
+	return m.Formula
+}
+
+// ***************************************************************************
+// SNAPSHOTS
+// ***************************************************************************
+
+// A regex and its classes
+type SnapshotRegex struct {
+	Regex   Regex
+	Classes []string
+}
+
+func Snapshot(db *gorm.DB, dc, env string) ([]SnapshotRegex, error) {
+
+	// Return the regexes in dc and env, in precedence order, with their
+	// classes. It doesn't lock so that it can be used in a transaction; the
+	// caller must hold the lock.
+
+	snapshot := []SnapshotRegex{}
+
+	regexes := []Regex{}
+	if err := db.Order("priority desc, id").Find(&regexes, "dc = ? and env = ?",
+		dc, env); err.Error != nil {
+		if !err.RecordNotFound() {
+			return snapshot, err.Error
+		}
+	}
+
+	ids := []int64{}
+	for i := range regexes {
+		ids = append(ids, regexes[i].Id)
+	}
+
+	maps := []RegexSlsMap{}
+	if len(ids) > 0 {
+		if err := db.Order("id").Where("regex_id in (?)", ids).Find(
+			&maps); err.Error != nil {
+			if !err.RecordNotFound() {
+				return snapshot, err.Error
+			}
+		}
+	}
+
+	classes := make(map[int64][]string)
+	for _, m := range maps {
+		// Older versions saved blank classes, which give no state
+		if len(strings.TrimSpace(m.Class())) == 0 {
+			continue
+		}
+		classes[m.RegexId] = append(classes[m.RegexId], m.Class())
+	}
+
+	for i := range regexes {
+		snapshotregex := SnapshotRegex{regexes[i], classes[regexes[i].Id]}
+		if snapshotregex.Classes == nil {
+			snapshotregex.Classes = []string{}
+		}
+		snapshot = append(snapshot, snapshotregex)
+	}
+
+	return snapshot, nil
+}
+
+// ***************************************************************************
+// DIFF
+// ***************************************************************************
+
+// A field that differs between two versions of a regex
+type FieldDiff struct {
+	Field  string
+	Before interface{}
+	After  interface{}
+}
+
+// How a regex differs between two configurations
+type RegexDiff struct {
+	Name           string
+	Fields         []FieldDiff
+	AddedClasses   []string
+	RemovedClasses []string
+}
+
+type Diff struct {
+	Added   []SnapshotRegex // Regexes only in the second configuration
+	Removed []SnapshotRegex // Regexes only in the first configuration
+	Changed []RegexDiff
+}
+
+func DiffRegex(before, after SnapshotRegex) RegexDiff {
+
+	// Compare two versions of a regex, ignoring where they are kept
+
+	b := before.Regex
+	a := after.Regex
+	for _, regex := range []*Regex{&b, &a} {
+		if len(regex.Rule) == 0 {
+			regex.Rule = RuleInclude
+		}
+		if len(regex.MatchType) == 0 {
+			regex.MatchType = MatchPcre
+		}
+	}
+
+	diff := RegexDiff{
+		Name:           a.Name,
+		Fields:         []FieldDiff{},
+		AddedClasses:   []string{},
+		RemovedClasses: []string{},
+	}
+
+	fields := []FieldDiff{
+		{"Regex", b.Regex, a.Regex},
+		{"Desc", b.Desc, a.Desc},
+		{"Priority", b.Priority, a.Priority},
+		{"Rule", b.Rule, a.Rule},
+		{"MatchType", b.MatchType, a.MatchType},
+		{"IgnoreCase", b.IgnoreCase, a.IgnoreCase},
+		{"FullMatch", b.FullMatch, a.FullMatch},
+	}
+	for _, field := range fields {
+		if field.Before != field.After {
+			diff.Fields = append(diff.Fields, field)
+		}
+	}
+
+	had := make(map[string]bool)
+	for _, class := range before.Classes {
+		had[class] = true
+	}
+	has := make(map[string]bool)
+	for _, class := range after.Classes {
+		has[class] = true
+		if !had[class] {
+			diff.AddedClasses = append(diff.AddedClasses, class)
+		}
+	}
+	for _, class := range before.Classes {
+		if !has[class] {
+			diff.RemovedClasses = append(diff.RemovedClasses, class)
+		}
+	}
+
+	return diff
+}
+
+func DiffSnapshots(from, to []SnapshotRegex) Diff {
+
+	// Compare two configurations by regex Name. Regexes sharing a Name are
+	// paired up in precedence order.
+
+	diff := Diff{
+		Added:   []SnapshotRegex{},
+		Removed: []SnapshotRegex{},
+		Changed: []RegexDiff{},
+	}
+
+	byname := make(map[string][]int) // Indexes in from
+	for i := range from {
+		name := from[i].Regex.Name
+		byname[name] = append(byname[name], i)
+	}
+
+	paired := make([]bool, len(from))
+	for _, after := range to {
+		name := after.Regex.Name
+		if len(byname[name]) == 0 {
+			diff.Added = append(diff.Added, after)
+			continue
+		}
+		i := byname[name][0]
+		byname[name] = byname[name][1:]
+		paired[i] = true
+		regexdiff := DiffRegex(from[i], after)
+		if len(regexdiff.Fields) > 0 || len(regexdiff.AddedClasses) > 0 ||
+			len(regexdiff.RemovedClasses) > 0 {
+			diff.Changed = append(diff.Changed, regexdiff)
+		}
+	}
+
+	for i := range from {
+		if !paired[i] {
+			diff.Removed = append(diff.Removed, from[i])
+		}
+	}
+
+	return diff
+}
+
+func DuplicateNames(snapshot []SnapshotRegex) []string {
+
+	// Return the names used by more than one regex. Regexes are matched by
+	// name, so these can't be paired up reliably.
+
+	count := make(map[string]int)
+	names := []string{}
+	for _, s := range snapshot {
+		count[s.Regex.Name]++
+		if count[s.Regex.Name] == 2 {
+			names = append(names, s.Regex.Name)
+		}
+	}
+
+	return names
+}
+
+// ***************************************************************************
+// GO RPC PLUGIN
+// ***************************************************************************
+
+type EnvDiffOut struct {
+	From string // dc/env of env_id
+	To   string // dc/env of to_env_id
+	Diff Diff   // How the second environment differs from the first
+
+	// Names used by more than one regex in either environment. Those
+	// regexes are paired up in precedence order so may be wrongly paired.
+	Duplicates []string
+}
+
+func Unlock() {
+
+	config.Portlock.Unlock()
+}
+
+func Lock() {
+
+	config.Portlock.Lock()
+}
+
+func (t *Plugin) GetRequest(args *Args, response *[]byte) error {
+
+	// Compare the regexes and classes of the environment 'env_id' with
+	// those of 'to_env_id', matching regexes by Name. Regexes only in
+	// 'to_env_id' are added, those only in 'env_id' are removed. Nothing is
+	// changed.
+
+	if len(args.QueryString["env_id"]) == 0 {
+		ReturnError("'env_id' must be set", response)
+		return nil
+	}
+
+	if len(args.QueryString["to_env_id"]) == 0 {
+		ReturnError("'to_env_id' must be set", response)
+		return nil
+	}
+
+	env_id_str := args.QueryString["env_id"][0]
+	to_env_id_str := args.QueryString["to_env_id"][0]
+
+	// Check if the user is allowed to access both environments
+	var err error
+	var fromenv Env
+	if fromenv, err = t.GetAllowedEnv(args, env_id_str, response); err != nil {
+		// GetAllowedEnv wrote the error
+		return nil
+	}
+
+	var toenv Env
+	if toenv, err = t.GetAllowedEnv(args, to_env_id_str, response); err != nil {
+		// GetAllowedEnv wrote the error
+		return nil
+	}
+
+	// PluginDatabasePath is required to open our private db
+	if len(args.PathParams["PluginDatabasePath"]) == 0 {
+		ReturnError("Internal Error: 'PluginDatabasePath' must be set", response)
+		return nil
+	}
+
+	config.SetDBPath(args.PathParams["PluginDatabasePath"])
+
+	// Open/Create database
+	var gormInst *GormDB
+	if gormInst, err = NewDB(); err != nil {
+		txt := "GormDB open error for '" + config.DBPath() + "enc.db'. " +
+			err.Error()
+		ReturnError(txt, response)
+		return nil
+	}
+
+	db := gormInst.DB() // shortcut
+
+	// Read both environments under the lock so neither changes in between
+
+	Lock()
+	from, err := Snapshot(db, fromenv.DcSysName, fromenv.SysName)
+	if err != nil {
+		Unlock()
+		ReturnError(err.Error(), response)
+		return nil
+	}
+	to, err := Snapshot(db, toenv.DcSysName, toenv.SysName)
+	if err != nil {
+		Unlock()
+		ReturnError(err.Error(), response)
+		return nil
+	}
+	Unlock()
+
+	out := EnvDiffOut{
+		From: fromenv.DcSysName + "/" + fromenv.SysName,
+		To:   toenv.DcSysName + "/" + toenv.SysName,
+		Diff: DiffSnapshots(from, to),
+	}
+
+	seen := make(map[string]bool)
+	out.Duplicates = []string{}
+	for _, name := range append(DuplicateNames(from), DuplicateNames(to)...) {
+		if !seen[name] {
+			seen[name] = true
+			out.Duplicates = append(out.Duplicates, name)
+		}
+	}
+
+	// Output as JSON
+
+	TempJsonData, err := json.Marshal(out)
+	if err != nil {
+		ReturnError("Marshal error: "+err.Error(), response)
+		return nil
+	}
+	reply := Reply{0, string(TempJsonData), SUCCESS, ""}
+	jsondata, err := json.Marshal(reply)
+
+	if err != nil {
+		ReturnError("Marshal error: "+err.Error(), response)
+		return nil
+	}
+
+	*response = jsondata
+
+	return nil
+}
+
+func (t *Plugin) HandleRequest(args *Args, response *[]byte) error {
+
+	// All plugins must have this.
+
+	if len(args.QueryType) > 0 {
+		switch args.QueryType {
+		case "GET":
+			t.GetRequest(args, response)
+			return nil
+		}
+		ReturnError("Internal error: Invalid HTTP request type for this plugin "+
+			args.QueryType, response)
+		return nil
+	} else {
+		ReturnError("Internal error: HTTP request type was not set", response)
+		return nil
+	}
+}
+
+// ***************************************************************************
+// ENTRY POINT
+// ***************************************************************************
+
+func main() {
+
+	// Sets the global config var
+	NewConfig()
+
+	// Create a lock file to use for synchronisation
+	config.Port = 49993
+	config.Portlock = NewPortLock(config.Port)
+
+	plugin := new(Plugin)
+	rpc.Register(plugin)
+
+	listener, err := net.Listen("tcp", ":"+os.Args[1])
+	if err != nil {
+		txt := fmt.Sprintf("Listen error. %s", err)
+		logit(txt)
+	}
+
+	if conn, err := listener.Accept(); err != nil {
+		txt := fmt.Sprintf("Accept error. %s", err)
+		logit(txt)
+	} else {
+		rpc.ServeConn(conn)
+	}
+}
+
+// vim:ts=2:sw=2
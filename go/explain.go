@@ -0,0 +1,943 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+	"net"
+	"net/rpc"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ***************************************************************************
+// SQLITE3 PRIVATE DB
+// ***************************************************************************
+
+type Enc struct {
+	Id        int64
+	SaltId    string // Name of the server
+	Formula   string // Directory name
+	StateFile string // Sls file name
+	Dc        string // Data centre name
+	Env       string // Environment name
+	Untested  bool   // Cidr regexes that may give classes were not tested
+}
+
+type Regex struct {
+	Id         int64
+	Regex      string // The regular expression
+	Dc         string // Data centre name
+	Env        string // Environment name
+	Name       string // Short name for the regex, no spaces
+	Desc       string // Description of the regex
+	Priority   int64  // Higher priority regexes take precedence
+	Rule       string // "include" (or empty) adds classes, "exclude" removes
+	MatchType  string // "pcre" (or empty), "glob", "list" or "cidr"
+	IgnoreCase bool   // Match salt ids case insensitively
+	FullMatch  bool   // A pcre regex must match the whole salt id
+}
+
+const (
+	RuleInclude = "include"
+	RuleExclude = "exclude"
+)
+
+type RegexSlsMap struct {
+	Id        int64
+	RegexId   int64  // Not null
+	Formula   string // Not null
+	StateFile string // Can be null, dotted if nested, e.g. mods.ssl
+}
+
+type HostOverride struct {
+	Id        int64
+	SaltId    string // Name of the server
+	Formula   string // Not null
+	StateFile string // Can be null, dotted if nested, e.g. mods.ssl
+	Action    string // "add" or "remove" the class
+	Dc        string // Data centre name
+	Env       string // Environment name
+}
+
+const (
+	ActionAdd    = "add"
+	ActionRemove = "remove"
+)
+
+type Audit struct {
+	Id      int64
+	Login   string    // Who made the change
+	Time    time.Time // When the change was saved, in UTC
+	Dc      string    // Data centre name
+	Env     string    // Environment name
+	Action  string    // "create", "update" or "delete"
+	Kind    string    // "regex" or "classes"
+	RegexId int64     // The regex that changed, or whose classes changed
+	Before  string    // JSON of the values before, empty if created
+	After   string    // JSON of the values after, empty if deleted
+}
+
+type Revision struct {
+	Id       int64
+	Dc       string    // Data centre name
+	Env      string    // Environment name
+	Number   int64     // Counts up from 1 in each environment
+	Login    string    // Who made the change
+	Time     time.Time // When the change was saved, in UTC
+	Reason   string    // What changed
+	Snapshot string    // JSON of the regexes and their classes afterwards
+}
+
+// --
+
+var config *Config
+
+type Config struct {
+	Dbname   string
+	Portlock *PortLock
+	Port     int
+}
+
+func (c *Config) DBPath() string {
+
+	return c.Dbname
+}
+
+func (c *Config) SetDBPath(path string) {
+
+	c.Dbname = path
+}
+
+func NewConfig() {
+
+	config = &Config{}
+}
+
+// --
+
+type GormDB struct {
+	db gorm.DB
+}
+
+func (gormInst *GormDB) InitDB() error {
+
+	var err error
+	dbname := config.DBPath()
+
+	gormInst.db, err = gorm.Open("sqlite3", dbname+"enc.db")
+	if err != nil {
+		return ApiError{"Open " + dbname + " failed. " + err.Error()}
+	}
+
+	if err := gormInst.db.AutoMigrate(Enc{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate Enc table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(Regex{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate Regex table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(RegexSlsMap{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate RegexSlsMap table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(HostOverride{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate HostOverride table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(Audit{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate Audit table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(Revision{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate Revision table failed: %s", err)
+		return ApiError{txt}
+	}
+
+	// Unique index is also a constraint, so are forced to be unique
+	gormInst.db.Model(Enc{}).AddIndex("idx_enc_salt_id", "salt_id")
+	gormInst.db.Model(HostOverride{}).AddIndex("idx_host_override_salt_id",
+		"salt_id")
+	gormInst.db.Model(Audit{}).AddIndex("idx_audit_dc_env", "dc", "env")
+	gormInst.db.Model(Revision{}).AddIndex("idx_revision_dc_env", "dc", "env")
+
+	return nil
+}
+
+func (gormInst *GormDB) DB() *gorm.DB {
+
+	return &gormInst.db
+}
+
+func NewDB() (*GormDB, error) {
+
+	gormInst := &GormDB{}
+	if err := gormInst.InitDB(); err != nil {
+		return gormInst, err
+	}
+	return gormInst, nil
+}
+
+// ***************************************************************************
+// PORT LOCKING
+// ***************************************************************************
+
+// PortLock is a locker which locks by binding to a port on the loopback IPv4
+// interface
+type PortLock struct {
+	hostport string
+	ln       net.Listener
+}
+
+func NewPortLock(port int) *PortLock {
+
+	// NewFLock creates new Flock-based lock (unlocked first)
+	return &PortLock{hostport: net.JoinHostPort("127.0.0.1", strconv.Itoa(port))}
+}
+
+func (p *PortLock) Lock() {
+
+	// Lock acquires the lock, blocking
+	t := 50 * time.Millisecond
+	for {
+		if l, err := net.Listen("tcp", p.hostport); err == nil {
+			p.ln = l // thanks to zhangpy
+			return
+		}
+		//log.Printf("spinning lock on %s (%s)", p.hostport, err)
+		time.Sleep(t)
+		//t = time.Duration(
+		//  math.Min( float64(time.Duration(float32(t) * 1.5)), 2000 ))
+	}
+}
+
+func (p *PortLock) Unlock() {
+
+	// Unlock releases the lock
+	if p.ln != nil {
+		p.ln.Close()
+	}
+}
+
+// ***************************************************************************
+// MATCH TYPES
+// ***************************************************************************
+
+const (
+	MatchPcre = "pcre" // A regular expression, the default
+	MatchGlob = "glob" // A shell style glob, e.g. web*
+	MatchList = "list" // A comma separated list of salt ids
+	MatchCidr = "cidr" // Comma separated networks matched against the address
+)
+
+func GlobToRegex(glob string) string {
+
+	// Convert a shell style glob, as used by Salt's glob matcher, to an
+	// anchored regex
+
+	expr := "^"
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			expr += ".*"
+		case '?':
+			expr += "."
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				expr += regexp.QuoteMeta(string(c))
+				continue
+			}
+			// fnmatch negates a set with !, and a ^ in it is just a ^
+			set := strings.Replace(glob[i+1:i+1+end], `\`, `\\`, -1)
+			if strings.HasPrefix(set, "!") {
+				set = "^" + set[1:]
+			} else if strings.HasPrefix(set, "^") {
+				set = `\` + set
+			}
+			expr += "[" + set + "]"
+			i += end + 1
+		default:
+			expr += regexp.QuoteMeta(string(c))
+		}
+	}
+
+	return expr + "$"
+}
+
+func SplitList(list string) []string {
+
+	// Return the non-empty items of a comma separated list
+
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func ListToRegex(list string) string {
+
+	// Convert a comma separated list of salt ids to an anchored regex
+
+	saltids := SplitList(list)
+	for i := range saltids {
+		saltids[i] = regexp.QuoteMeta(saltids[i])
+	}
+
+	return "^(?:" + strings.Join(saltids, "|") + ")$"
+}
+
+func ParseNets(cidrs string) ([]*net.IPNet, error) {
+
+	// Parse a comma separated list of networks, e.g. 10.1.0.0/16, or single
+	// addresses
+
+	nets := []*net.IPNet{}
+	for _, cidr := range SplitList(cidrs) {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nets, ApiError{"'" + cidr + "' is not an address or network"}
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nets, ApiError{"'" + cidr + "' is not an address or network"}
+		}
+		nets = append(nets, ipnet)
+	}
+
+	if len(nets) == 0 {
+		return nets, ApiError{"no networks given"}
+	}
+
+	return nets, nil
+}
+
+func MatchExpr(regex Regex) string {
+
+	// Return the regex that salt ids are tested against for a pcre, glob or
+	// list match, with the regex's IgnoreCase and FullMatch flags applied
+
+	expr := regex.Regex
+	switch regex.MatchType {
+	case MatchGlob:
+		expr = GlobToRegex(expr)
+	case MatchList:
+		expr = ListToRegex(expr)
+	default:
+		if regex.FullMatch {
+			expr = "^(?:" + expr + ")$"
+		}
+	}
+	if regex.IgnoreCase {
+		expr = "(?i)" + expr
+	}
+
+	return expr
+}
+
+func MatchRegexp(regex Regex) (*regexp.Regexp, error) {
+
+	// Return the compiled regex that salt ids are tested against for any
+	// match type. Cidr matches test the host's address instead so have no
+	// regex.
+
+	if regex.MatchType == MatchCidr {
+		_, err := ParseNets(regex.Regex)
+		return nil, err
+	}
+
+	return regexp.Compile(MatchExpr(regex))
+}
+
+// ***************************************************************************
+// CLASSIFICATION
+// ***************************************************************************
+
+func (m RegexSlsMap) Class() string {
+
+	// The class name as written in a top file, formula or formula.statefile
+
+	if len(m.StateFile) > 0 {
+		return m.Formula + "." + m.StateFile
+	}
+	return m.Formula
+}
+
+func LoadRegexes(db *gorm.DB, dc, env string) ([]Regex, error) {
+
+	// Return all regexes for an environment in precedence order, highest
+	// priority first. Regexes with the same priority are in the order they
+	// were added.
+
+	regexes := []Regex{}
+	Lock()
+	if err := db.Order("priority desc, id").Find(&regexes,
+		"dc = ? and env = ?", dc, env); err.Error != nil {
+		if !err.RecordNotFound() {
+			Unlock()
+			return regexes, err.Error
+		}
+	}
+	Unlock()
+
+	return regexes, nil
+}
+
+func LoadMaps(db *gorm.DB, regexes []Regex) (map[int64][]RegexSlsMap, error) {
+
+	// Return the RegexSlsMaps for each regex, keyed by RegexId
+
+	maps := make(map[int64][]RegexSlsMap)
+	if len(regexes) == 0 {
+		return maps, nil
+	}
+
+	ids := []int64{}
+	for i := range regexes {
+		ids = append(ids, regexes[i].Id)
+	}
+
+	rows := []RegexSlsMap{}
+	Lock()
+	if err := db.Order("id").Find(&rows, "regex_id in (?)", ids); err.Error != nil {
+		if !err.RecordNotFound() {
+			Unlock()
+			return maps, err.Error
+		}
+	}
+	Unlock()
+
+	for i := range rows {
+		maps[rows[i].RegexId] = append(maps[rows[i].RegexId], rows[i])
+	}
+
+	return maps, nil
+}
+
+// A regex compiled and ready to be tested against salt ids
+type Matcher struct {
+	Regex   Regex
+	Classes []string // Classes from the regex's RegexSlsMaps
+	Error   string   // Why the regex can't be used, empty if it can
+	re      *regexp.Regexp
+	nets    []*net.IPNet // Networks for cidr matches
+}
+
+func NewMatchers(regexes []Regex,
+	maps map[int64][]RegexSlsMap) []Matcher {
+
+	// Compile each regex and gather its classes. The order of regexes is
+	// kept. Regexes saved before they were validated may not compile. They
+	// are logged and kept with their Error set, so they can be reported,
+	// but never match.
+
+	matchers := []Matcher{}
+
+	for i := range regexes {
+		re, err := MatchRegexp(regexes[i])
+		matcher := Matcher{
+			Regex:   regexes[i],
+			Classes: []string{},
+			re:      re,
+		}
+		if err != nil {
+			txt := fmt.Sprintf("Regex '%s' (Id:%d) does not compile: %s",
+				regexes[i].Name, regexes[i].Id, err.Error())
+			logit(txt)
+			matcher.Error = err.Error()
+		}
+		if len(matcher.Regex.Rule) == 0 {
+			matcher.Regex.Rule = RuleInclude
+		}
+		if len(matcher.Regex.MatchType) == 0 {
+			matcher.Regex.MatchType = MatchPcre
+		}
+		if matcher.Regex.MatchType == MatchCidr {
+			matcher.nets, _ = ParseNets(regexes[i].Regex)
+		}
+		for _, m := range maps[regexes[i].Id] {
+			if class := m.Class(); len(class) > 0 {
+				matcher.Classes = append(matcher.Classes, class)
+			}
+		}
+		matchers = append(matchers, matcher)
+	}
+
+	return matchers
+}
+
+func LoadMatchers(db *gorm.DB, dc, env string) ([]Matcher, error) {
+
+	// Return matchers for all regexes in dc and env, in precedence order
+
+	regexes, err := LoadRegexes(db, dc, env)
+	if err != nil {
+		return []Matcher{}, err
+	}
+
+	maps, err := LoadMaps(db, regexes)
+	if err != nil {
+		return []Matcher{}, err
+	}
+
+	return NewMatchers(regexes, maps), nil
+}
+
+func (m Matcher) Match(saltid, addr string) []int {
+
+	// Return the start and end offsets of the match in saltid, or nil if
+	// there is no match. Cidr matches test addr, the host's address if
+	// known, and give an empty span. Regexes that don't compile never
+	// match.
+
+	if len(m.Error) > 0 {
+		return nil
+	}
+
+	if m.Regex.MatchType == MatchCidr {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil
+		}
+		for _, ipnet := range m.nets {
+			if ipnet.Contains(ip) {
+				return []int{0, 0}
+			}
+		}
+		return nil
+	}
+
+	return m.re.FindStringIndex(saltid)
+}
+
+// A placeholder in a class, e.g. the {role} in app.{role}, filled from the
+// regex's named capture group of the same name
+var placeholder = regexp.MustCompile(`\{(\w+)\}`)
+
+func (m Matcher) Expand(saltid string) []string {
+
+	// Return the matcher's classes for saltid with any placeholders filled
+	// in. A class is left out if one of its groups took no part in the
+	// match.
+
+	classes := []string{}
+
+	if m.re == nil {
+		// Cidr matches have no capture groups
+		for _, class := range m.Classes {
+			if !placeholder.MatchString(class) {
+				classes = append(classes, class)
+			}
+		}
+		return classes
+	}
+
+	match := m.re.FindStringSubmatchIndex(saltid)
+	if match == nil {
+		return classes
+	}
+
+	for _, class := range m.Classes {
+		ok := true
+		expanded := placeholder.ReplaceAllStringFunc(class, func(s string) string {
+			i := m.re.SubexpIndex(s[1 : len(s)-1])
+			if i < 0 || match[2*i] < 0 || match[2*i] == match[2*i+1] {
+				ok = false
+				return s
+			}
+			return saltid[match[2*i]:match[2*i+1]]
+		})
+		if ok {
+			classes = append(classes, expanded)
+		}
+	}
+
+	return classes
+}
+
+// The outcome of testing one regex against a salt id
+type RegexResult struct {
+	RegexId   int64
+	Name      string
+	Regex     string
+	MatchType string
+	Priority  int64
+	Rule      string
+	Matched   bool
+	Span      []int    // Start and end offsets of the match in the salt id
+	Classes   []string // Classes the regex included or excluded
+	Ignored   []string // Classes already decided by a higher priority regex
+	Untested  bool     // A cidr match with no address to test against
+	Error     string   // Why the regex was skipped, if it doesn't compile
+}
+
+func Evaluate(matchers []Matcher, saltid, addr string) ([]RegexResult,
+	[]string) {
+
+	// Test every matcher against saltid, and addr for cidr matches, in
+	// precedence order, and return the result for each regex along with the
+	// final list of classes.
+	//
+	// The first matching regex to mention a class decides it: an include
+	// rule adds the class and an exclude rule removes it. Lower priority
+	// regexes mentioning the same class are ignored for that class.
+	//
+	// Cidr regexes can't be tested without an address. They are marked
+	// Untested and list the undecided classes they may have included or
+	// excluded, which are left undecided. Regexes that don't compile are
+	// skipped and their result has the Error.
+
+	results := []RegexResult{}
+	classes := []string{}
+
+	decided := make(map[string]bool)
+	for i := range matchers {
+		regex := matchers[i].Regex
+		result := RegexResult{
+			RegexId:   regex.Id,
+			Name:      regex.Name,
+			Regex:     regex.Regex,
+			MatchType: regex.MatchType,
+			Priority:  regex.Priority,
+			Rule:      regex.Rule,
+			Classes:   []string{},
+			Ignored:   []string{},
+		}
+		if len(matchers[i].Error) > 0 {
+			result.Error = matchers[i].Error
+		} else if regex.MatchType == MatchCidr && net.ParseIP(addr) == nil {
+			result.Untested = true
+			for _, class := range matchers[i].Expand(saltid) {
+				if !decided[class] {
+					result.Classes = append(result.Classes, class)
+				}
+			}
+		} else if span := matchers[i].Match(saltid, addr); span != nil {
+			result.Matched = true
+			result.Span = span
+			for _, class := range matchers[i].Expand(saltid) {
+				if decided[class] {
+					result.Ignored = append(result.Ignored, class)
+					continue
+				}
+				decided[class] = true
+				result.Classes = append(result.Classes, class)
+				if result.Rule == RuleInclude {
+					classes = append(classes, class)
+				}
+			}
+		}
+		results = append(results, result)
+	}
+
+	return results, classes
+}
+
+func UntestedClasses(results []RegexResult) []string {
+
+	// Return the classes that untested cidr regexes may have included or
+	// excluded
+
+	classes := []string{}
+	for i := range results {
+		if results[i].Untested {
+			classes = append(classes, results[i].Classes...)
+		}
+	}
+
+	return classes
+}
+
+func (o HostOverride) Class() string {
+
+	// Return the override's class name, e.g. mods.ssl
+
+	if len(o.StateFile) == 0 {
+		return o.Formula
+	}
+	return o.Formula + "." + o.StateFile
+}
+
+func LoadOverrides(db *gorm.DB, dc, env string) (map[string][]HostOverride,
+	error) {
+
+	// Return the host overrides in dc and env keyed by salt id
+
+	overrides := []HostOverride{}
+	Lock()
+	if err := db.Order("id").Find(&overrides, "dc = ? and env = ?", dc,
+		env); err.Error != nil {
+		if !err.RecordNotFound() {
+			Unlock()
+			return map[string][]HostOverride{}, err.Error
+		}
+	}
+	Unlock()
+
+	byhost := make(map[string][]HostOverride)
+	for _, override := range overrides {
+		byhost[override.SaltId] = append(byhost[override.SaltId], override)
+	}
+
+	return byhost, nil
+}
+
+func ApplyOverrides(classes []string, overrides []HostOverride) ([]string,
+	[]string, []string) {
+
+	// Merge one salt id's overrides into the classes decided by the regexes.
+	// Overrides always win over the regexes. Returns the final classes, the
+	// classes added by overrides and the classes removed by overrides.
+
+	remove := make(map[string]bool)
+	for _, override := range overrides {
+		if override.Action == ActionRemove {
+			remove[override.Class()] = true
+		}
+	}
+
+	final := []string{}
+	added := []string{}
+	removed := []string{}
+
+	have := make(map[string]bool)
+	for _, class := range classes {
+		if remove[class] {
+			removed = append(removed, class)
+			continue
+		}
+		have[class] = true
+		final = append(final, class)
+	}
+
+	for _, override := range overrides {
+		class := override.Class()
+		if override.Action == ActionAdd && !have[class] {
+			have[class] = true
+			final = append(final, class)
+			added = append(added, class)
+		}
+	}
+
+	return final, added, removed
+}
+
+// ***************************************************************************
+// GO RPC PLUGIN
+// ***************************************************************************
+
+// A class added or removed by a host override
+type OverrideResult struct {
+	Class  string
+	Action string // "add" or "remove"
+}
+
+type ExplainOut struct {
+	SaltId    string
+	Ip        string // The address used for cidr matches, if given
+	Dc        string
+	Env       string
+	Regexes   []RegexResult    // Every regex that was tested
+	Overrides []OverrideResult // Classes changed by host overrides
+	Classes   []string         // The classes the salt id is given
+}
+
+func Unlock() {
+
+	config.Portlock.Unlock()
+}
+
+func Lock() {
+
+	config.Portlock.Lock()
+}
+
+func (t *Plugin) GetRequest(args *Args, response *[]byte) error {
+
+	// Show how the classes for a salt id were worked out. Each regex is
+	// listed with whether it matched, where, and the classes it added. The
+	// host's address can be given in 'ip' for cidr matches.
+
+	if len(args.QueryString["env_id"]) == 0 {
+		ReturnError("'env_id' must be set", response)
+		return nil
+	}
+
+	if len(args.QueryString["salt_id"]) == 0 {
+		ReturnError("'salt_id' must be set", response)
+		return nil
+	}
+
+	env_id_str := args.QueryString["env_id"][0]
+	salt_id := args.QueryString["salt_id"][0]
+
+	ip := ""
+	if len(args.QueryString["ip"]) > 0 {
+		ip = args.QueryString["ip"][0]
+	}
+
+	// Check if the user is allowed to access the environment
+	var err error
+	var foundenv Env
+	if foundenv, err = t.GetAllowedEnv(args, env_id_str, response); err != nil {
+		// GetAllowedEnv wrote the error
+		return nil
+	}
+
+	dc := foundenv.DcSysName
+	env := foundenv.SysName
+
+	// PluginDatabasePath is required to open our private db
+	if len(args.PathParams["PluginDatabasePath"]) == 0 {
+		ReturnError("Internal Error: 'PluginDatabasePath' must be set", response)
+		return nil
+	}
+
+	config.SetDBPath(args.PathParams["PluginDatabasePath"])
+
+	// Open/Create database
+	var gormInst *GormDB
+	if gormInst, err = NewDB(); err != nil {
+		txt := "GormDB open error for '" + config.DBPath() + "enc.db'. " +
+			err.Error()
+		ReturnError(txt, response)
+		return nil
+	}
+
+	db := gormInst.DB() // shortcut
+
+	matchers, err := LoadMatchers(db, dc, env)
+	if err != nil {
+		ReturnError(err.Error(), response)
+		return nil
+	}
+
+	overrides, err := LoadOverrides(db, dc, env)
+	if err != nil {
+		ReturnError(err.Error(), response)
+		return nil
+	}
+
+	results, classes := Evaluate(matchers, salt_id, ip)
+	classes, added, removed := ApplyOverrides(classes, overrides[salt_id])
+
+	// Output as JSON
+
+	out := ExplainOut{
+		SaltId:    salt_id,
+		Ip:        ip,
+		Dc:        dc,
+		Env:       env,
+		Regexes:   results,
+		Overrides: []OverrideResult{},
+		Classes:   classes,
+	}
+	for _, class := range added {
+		out.Overrides = append(out.Overrides,
+			OverrideResult{Class: class, Action: ActionAdd})
+	}
+	for _, class := range removed {
+		out.Overrides = append(out.Overrides,
+			OverrideResult{Class: class, Action: ActionRemove})
+	}
+
+	TempJsonData, err := json.Marshal(out)
+	if err != nil {
+		ReturnError("Marshal error: "+err.Error(), response)
+		return nil
+	}
+	reply := Reply{0, string(TempJsonData), SUCCESS, ""}
+	jsondata, err := json.Marshal(reply)
+
+	if err != nil {
+		ReturnError("Marshal error: "+err.Error(), response)
+		return nil
+	}
+
+	*response = jsondata
+
+	return nil
+}
+
+func (t *Plugin) HandleRequest(args *Args, response *[]byte) error {
+
+	// All plugins must have this.
+
+	if len(args.QueryType) > 0 {
+		switch args.QueryType {
+		case "GET":
+			t.GetRequest(args, response)
+			return nil
+		}
+		ReturnError("Internal error: Invalid HTTP request type for this plugin "+
+			args.QueryType, response)
+		return nil
+	} else {
+		ReturnError("Internal error: HTTP request type was not set", response)
+		return nil
+	}
+}
+
+// ***************************************************************************
+// ENTRY POINT
+// ***************************************************************************
+
+func main() {
+
+	// Sets the global config var
+	NewConfig()
+
+	// Create a lock file to use for synchronisation
+	config.Port = 49993
+	config.Portlock = NewPortLock(config.Port)
+
+	plugin := new(Plugin)
+	rpc.Register(plugin)
+
+	listener, err := net.Listen("tcp", ":"+os.Args[1])
+	if err != nil {
+		txt := fmt.Sprintf("Listen error. %s", err)
+		logit(txt)
+	}
+
+	if conn, err := listener.Accept(); err != nil {
+		txt := fmt.Sprintf("Accept error. %s", err)
+		logit(txt)
+	} else {
+		rpc.ServeConn(conn)
+	}
+}
+
+// vim:ts=2:sw=2
@@ -19,15 +19,17 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
 	"net"
 	"net/rpc"
 	"os"
-	"strings"
-	//"regexp"
-	"github.com/jinzhu/gorm"
-	_ "github.com/mattn/go-sqlite3"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
 )
 
 // ***************************************************************************
@@ -41,22 +43,72 @@ type Enc struct {
 	StateFile string // Sls file name
 	Dc        string // Data centre name
 	Env       string // Environment name
+	Untested  bool   // Cidr regexes that may give classes were not tested
 }
 
 type Regex struct {
-	Id    int64
-	Regex string // The regular expression
-	Dc    string // Data centre name
-	Env   string // Environment name
-	Name  string // Short name for the regex, no spaces
-	Desc  string // Description of the regex
+	Id         int64
+	Regex      string // The regular expression
+	Dc         string // Data centre name
+	Env        string // Environment name
+	Name       string // Short name for the regex, no spaces
+	Desc       string // Description of the regex
+	Priority   int64  // Higher priority regexes take precedence
+	Rule       string // "include" (or empty) adds classes, "exclude" removes
+	MatchType  string // "pcre" (or empty), "glob", "list" or "cidr"
+	IgnoreCase bool   // Match salt ids case insensitively
+	FullMatch  bool   // A pcre regex must match the whole salt id
 }
 
+const (
+	RuleInclude = "include"
+	RuleExclude = "exclude"
+)
+
 type RegexSlsMap struct {
 	Id        int64
 	RegexId   int64  // Not null
 	Formula   string // Not null
-	StateFile string // Can be null
+	StateFile string // Can be null, dotted if nested, e.g. mods.ssl
+}
+
+type HostOverride struct {
+	Id        int64
+	SaltId    string // Name of the server
+	Formula   string // Not null
+	StateFile string // Can be null, dotted if nested, e.g. mods.ssl
+	Action    string // "add" or "remove" the class
+	Dc        string // Data centre name
+	Env       string // Environment name
+}
+
+const (
+	ActionAdd    = "add"
+	ActionRemove = "remove"
+)
+
+type Audit struct {
+	Id      int64
+	Login   string    // Who made the change
+	Time    time.Time // When the change was saved, in UTC
+	Dc      string    // Data centre name
+	Env     string    // Environment name
+	Action  string    // "create", "update" or "delete"
+	Kind    string    // "regex" or "classes"
+	RegexId int64     // The regex that changed, or whose classes changed
+	Before  string    // JSON of the values before, empty if created
+	After   string    // JSON of the values after, empty if deleted
+}
+
+type Revision struct {
+	Id       int64
+	Dc       string    // Data centre name
+	Env      string    // Environment name
+	Number   int64     // Counts up from 1 in each environment
+	Login    string    // Who made the change
+	Time     time.Time // When the change was saved, in UTC
+	Reason   string    // What changed
+	Snapshot string    // JSON of the regexes and their classes afterwards
 }
 
 // --
@@ -112,9 +164,25 @@ func (gormInst *GormDB) InitDB() error {
 		txt := fmt.Sprintf("AutoMigrate RegexSlsMap table failed: %s", err)
 		return ApiError{txt}
 	}
+	if err := gormInst.db.AutoMigrate(HostOverride{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate HostOverride table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(Audit{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate Audit table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(Revision{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate Revision table failed: %s", err)
+		return ApiError{txt}
+	}
 
 	// Unique index is also a constraint, so are forced to be unique
 	gormInst.db.Model(Enc{}).AddIndex("idx_enc_salt_id", "salt_id")
+	gormInst.db.Model(HostOverride{}).AddIndex("idx_host_override_salt_id",
+		"salt_id")
+	gormInst.db.Model(Audit{}).AddIndex("idx_audit_dc_env", "dc", "env")
+	gormInst.db.Model(Revision{}).AddIndex("idx_revision_dc_env", "dc", "env")
 
 	return nil
 }
@@ -174,6 +242,853 @@ func (p *PortLock) Unlock() {
 	}
 }
 
+// ***************************************************************************
+// MATCH TYPES
+// ***************************************************************************
+
+const (
+	MatchPcre = "pcre" // A regular expression, the default
+	MatchGlob = "glob" // A shell style glob, e.g. web*
+	MatchList = "list" // A comma separated list of salt ids
+	MatchCidr = "cidr" // Comma separated networks matched against the address
+)
+
+func GlobToRegex(glob string) string {
+
+	// Convert a shell style glob, as used by Salt's glob matcher, to an
+	// anchored regex
+
+	expr := "^"
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			expr += ".*"
+		case '?':
+			expr += "."
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				expr += regexp.QuoteMeta(string(c))
+				continue
+			}
+			// fnmatch negates a set with !, and a ^ in it is just a ^
+			set := strings.Replace(glob[i+1:i+1+end], `\`, `\\`, -1)
+			if strings.HasPrefix(set, "!") {
+				set = "^" + set[1:]
+			} else if strings.HasPrefix(set, "^") {
+				set = `\` + set
+			}
+			expr += "[" + set + "]"
+			i += end + 1
+		default:
+			expr += regexp.QuoteMeta(string(c))
+		}
+	}
+
+	return expr + "$"
+}
+
+func SplitList(list string) []string {
+
+	// Return the non-empty items of a comma separated list
+
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func ListToRegex(list string) string {
+
+	// Convert a comma separated list of salt ids to an anchored regex
+
+	saltids := SplitList(list)
+	for i := range saltids {
+		saltids[i] = regexp.QuoteMeta(saltids[i])
+	}
+
+	return "^(?:" + strings.Join(saltids, "|") + ")$"
+}
+
+func ParseNets(cidrs string) ([]*net.IPNet, error) {
+
+	// Parse a comma separated list of networks, e.g. 10.1.0.0/16, or single
+	// addresses
+
+	nets := []*net.IPNet{}
+	for _, cidr := range SplitList(cidrs) {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nets, ApiError{"'" + cidr + "' is not an address or network"}
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nets, ApiError{"'" + cidr + "' is not an address or network"}
+		}
+		nets = append(nets, ipnet)
+	}
+
+	if len(nets) == 0 {
+		return nets, ApiError{"no networks given"}
+	}
+
+	return nets, nil
+}
+
+func MatchExpr(regex Regex) string {
+
+	// Return the regex that salt ids are tested against for a pcre, glob or
+	// list match, with the regex's IgnoreCase and FullMatch flags applied
+
+	expr := regex.Regex
+	switch regex.MatchType {
+	case MatchGlob:
+		expr = GlobToRegex(expr)
+	case MatchList:
+		expr = ListToRegex(expr)
+	default:
+		if regex.FullMatch {
+			expr = "^(?:" + expr + ")$"
+		}
+	}
+	if regex.IgnoreCase {
+		expr = "(?i)" + expr
+	}
+
+	return expr
+}
+
+func MatchRegexp(regex Regex) (*regexp.Regexp, error) {
+
+	// Return the compiled regex that salt ids are tested against for any
+	// match type. Cidr matches test the host's address instead so have no
+	// regex.
+
+	if regex.MatchType == MatchCidr {
+		_, err := ParseNets(regex.Regex)
+		return nil, err
+	}
+
+	return regexp.Compile(MatchExpr(regex))
+}
+
+// ***************************************************************************
+// CLASSES
+// ***************************************************************************
+
+func ParseClass(class string) (RegexSlsMap, error) {
+
+	// Split a class into its formula and the dotted path of the state file
+	// within the formula, e.g. 'apache.mods.ssl' is formula 'apache' and
+	// state file 'mods.ssl'. A trailing '.init' is dropped since Salt treats
+	// 'apache.init' and 'apache' as the same state.
+
+	regexmap := RegexSlsMap{}
+
+	if len(strings.TrimSpace(class)) == 0 {
+		return regexmap, ApiError{"Invalid class '" + class +
+			"': a class must not be empty"}
+	}
+
+	parts := strings.Split(class, ".")
+	for _, part := range parts {
+		if len(part) == 0 {
+			return regexmap, ApiError{"Invalid class '" + class +
+				"': names between dots must not be empty"}
+		}
+		if strings.IndexFunc(part, unicode.IsSpace) >= 0 {
+			return regexmap, ApiError{"Invalid class '" + class +
+				"': must not contain spaces"}
+		}
+	}
+
+	if len(parts) > 1 && parts[len(parts)-1] == "init" {
+		parts = parts[:len(parts)-1]
+	}
+
+	regexmap.Formula = parts[0]
+	regexmap.StateFile = strings.Join(parts[1:], ".")
+
+	return regexmap, nil
+}
+
+func (m RegexSlsMap) Class() string {
+
+	// The class name as written in a top file, formula or formula.statefile
+
+	if len(m.StateFile) > 0 {
+		return m.Formula + "." + m.StateFile
+	}
+	return m.Formula
+}
+
+// A placeholder in a class, e.g. the {role} in app.{role}, filled from the
+// regex's named capture group of the same name
+var placeholder = regexp.MustCompile(`\{(\w+)\}`)
+
+func CheckPlaceholders(class string, re *regexp.Regexp) error {
+
+	// Check that every placeholder in class names a capture group of re and
+	// that there are no stray braces. re is nil for cidr matches, which
+	// have no groups.
+
+	for _, m := range placeholder.FindAllStringSubmatch(class, -1) {
+		if re == nil || re.SubexpIndex(m[1]) < 0 {
+			return ApiError{"Invalid class '" + class + "': the regex has no " +
+				"capture group named '" + m[1] + "'"}
+		}
+	}
+
+	if strings.ContainsAny(placeholder.ReplaceAllString(class, ""), "{}") {
+		return ApiError{"Invalid class '" + class + "': placeholders must " +
+			"look like {name}"}
+	}
+
+	return nil
+}
+
+// ***************************************************************************
+// AUDIT
+// ***************************************************************************
+
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+const (
+	AuditRegex   = "regex"
+	AuditClasses = "classes"
+)
+
+func WriteAudit(tx *gorm.DB, audit Audit, before, after interface{}) error {
+
+	// Save an audit record with tx, the transaction making the change, so
+	// the change and its record are saved together or not at all. before
+	// and after are stored as JSON, nil meaning there was nothing.
+
+	audit.Time = time.Now().UTC()
+
+	if before != nil {
+		b, err := json.Marshal(before)
+		if err != nil {
+			return err
+		}
+		audit.Before = string(b)
+	}
+
+	if after != nil {
+		a, err := json.Marshal(after)
+		if err != nil {
+			return err
+		}
+		audit.After = string(a)
+	}
+
+	return tx.Create(&audit).Error
+}
+
+// ***************************************************************************
+// REVISIONS
+// ***************************************************************************
+
+// A regex and its classes as kept in a revision
+type SnapshotRegex struct {
+	Regex   Regex
+	Classes []string
+}
+
+func Snapshot(db *gorm.DB, dc, env string) ([]SnapshotRegex, error) {
+
+	// Return the regexes in dc and env, in precedence order, with their
+	// classes. It doesn't lock so that it can be used in a transaction; the
+	// caller must hold the lock.
+
+	snapshot := []SnapshotRegex{}
+
+	regexes := []Regex{}
+	if err := db.Order("priority desc, id").Find(&regexes, "dc = ? and env = ?",
+		dc, env); err.Error != nil {
+		if !err.RecordNotFound() {
+			return snapshot, err.Error
+		}
+	}
+
+	ids := []int64{}
+	for i := range regexes {
+		ids = append(ids, regexes[i].Id)
+	}
+
+	maps := []RegexSlsMap{}
+	if len(ids) > 0 {
+		if err := db.Order("id").Where("regex_id in (?)", ids).Find(
+			&maps); err.Error != nil {
+			if !err.RecordNotFound() {
+				return snapshot, err.Error
+			}
+		}
+	}
+
+	classes := make(map[int64][]string)
+	for _, m := range maps {
+		// Older versions saved blank classes, which give no state
+		if len(strings.TrimSpace(m.Class())) == 0 {
+			continue
+		}
+		classes[m.RegexId] = append(classes[m.RegexId], m.Class())
+	}
+
+	for i := range regexes {
+		snapshotregex := SnapshotRegex{regexes[i], classes[regexes[i].Id]}
+		if snapshotregex.Classes == nil {
+			snapshotregex.Classes = []string{}
+		}
+		snapshot = append(snapshot, snapshotregex)
+	}
+
+	return snapshot, nil
+}
+
+func LatestRevision(db *gorm.DB, dc, env string) (int64, error) {
+
+	// Return the newest revision number in dc and env, or 0 if there are
+	// none. The caller must hold the lock.
+
+	revisions := []Revision{}
+	if err := db.Order("number desc").Limit(1).Find(&revisions,
+		"dc = ? and env = ?", dc, env); err.Error != nil {
+		if !err.RecordNotFound() {
+			return 0, err.Error
+		}
+	}
+
+	if len(revisions) == 0 {
+		return 0, nil
+	}
+
+	return revisions[0].Number, nil
+}
+
+func WriteRevision(tx *gorm.DB, audit Audit, reason string) error {
+
+	// Save the regexes and classes in the audit record's environment, as
+	// they are in tx, as the next revision
+
+	number, err := LatestRevision(tx, audit.Dc, audit.Env)
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := Snapshot(tx, audit.Dc, audit.Env)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	revision := Revision{
+		Dc:       audit.Dc,
+		Env:      audit.Env,
+		Number:   number + 1,
+		Login:    audit.Login,
+		Time:     time.Now().UTC(),
+		Reason:   reason,
+		Snapshot: string(data),
+	}
+
+	return tx.Create(&revision).Error
+}
+
+func FirstRevision(tx *gorm.DB, audit Audit) error {
+
+	// Environments changed before revisions were kept have none, so save
+	// them as they are as the first revision. This must be called before tx
+	// changes anything.
+
+	number, err := LatestRevision(tx, audit.Dc, audit.Env)
+	if err != nil || number > 0 {
+		return err
+	}
+
+	return WriteRevision(tx, audit, "Configuration before revisions were kept")
+}
+
+// ***************************************************************************
+// CLASSIFICATION
+// ***************************************************************************
+
+func LoadRegexes(db *gorm.DB, dc, env string) ([]Regex, error) {
+
+	// Return all regexes for an environment in precedence order, highest
+	// priority first. Regexes with the same priority are in the order they
+	// were added. The caller must hold the lock.
+
+	regexes := []Regex{}
+	if err := db.Order("priority desc, id").Find(&regexes,
+		"dc = ? and env = ?", dc, env); err.Error != nil {
+		if !err.RecordNotFound() {
+			return regexes, err.Error
+		}
+	}
+
+	return regexes, nil
+}
+
+func LoadMaps(db *gorm.DB, regexes []Regex) (map[int64][]RegexSlsMap, error) {
+
+	// Return the RegexSlsMaps for each regex, keyed by RegexId. The caller
+	// must hold the lock.
+
+	maps := make(map[int64][]RegexSlsMap)
+	if len(regexes) == 0 {
+		return maps, nil
+	}
+
+	ids := []int64{}
+	for i := range regexes {
+		ids = append(ids, regexes[i].Id)
+	}
+
+	rows := []RegexSlsMap{}
+	if err := db.Order("id").Find(&rows, "regex_id in (?)", ids); err.Error != nil {
+		if !err.RecordNotFound() {
+			return maps, err.Error
+		}
+	}
+
+	for i := range rows {
+		maps[rows[i].RegexId] = append(maps[rows[i].RegexId], rows[i])
+	}
+
+	return maps, nil
+}
+
+// A regex compiled and ready to be tested against salt ids
+type Matcher struct {
+	Regex   Regex
+	Classes []string // Classes from the regex's RegexSlsMaps
+	Error   string   // Why the regex can't be used, empty if it can
+	re      *regexp.Regexp
+	nets    []*net.IPNet // Networks for cidr matches
+}
+
+func NewMatchers(regexes []Regex,
+	maps map[int64][]RegexSlsMap) []Matcher {
+
+	// Compile each regex and gather its classes. The order of regexes is
+	// kept. Regexes saved before they were validated may not compile. They
+	// are logged and kept with their Error set, so they can be reported,
+	// but never match.
+
+	matchers := []Matcher{}
+
+	for i := range regexes {
+		re, err := MatchRegexp(regexes[i])
+		matcher := Matcher{
+			Regex:   regexes[i],
+			Classes: []string{},
+			re:      re,
+		}
+		if err != nil {
+			txt := fmt.Sprintf("Regex '%s' (Id:%d) does not compile: %s",
+				regexes[i].Name, regexes[i].Id, err.Error())
+			logit(txt)
+			matcher.Error = err.Error()
+		}
+		if len(matcher.Regex.Rule) == 0 {
+			matcher.Regex.Rule = RuleInclude
+		}
+		if len(matcher.Regex.MatchType) == 0 {
+			matcher.Regex.MatchType = MatchPcre
+		}
+		if matcher.Regex.MatchType == MatchCidr {
+			matcher.nets, _ = ParseNets(regexes[i].Regex)
+		}
+		for _, m := range maps[regexes[i].Id] {
+			if class := m.Class(); len(class) > 0 {
+				matcher.Classes = append(matcher.Classes, class)
+			}
+		}
+		matchers = append(matchers, matcher)
+	}
+
+	return matchers
+}
+
+func LoadMatchers(db *gorm.DB, dc, env string) ([]Matcher, error) {
+
+	// Return matchers for all regexes in dc and env, in precedence order.
+	// The caller must hold the lock.
+
+	regexes, err := LoadRegexes(db, dc, env)
+	if err != nil {
+		return []Matcher{}, err
+	}
+
+	maps, err := LoadMaps(db, regexes)
+	if err != nil {
+		return []Matcher{}, err
+	}
+
+	return NewMatchers(regexes, maps), nil
+}
+
+func (m Matcher) Match(saltid, addr string) []int {
+
+	// Return the start and end offsets of the match in saltid, or nil if
+	// there is no match. Cidr matches test addr, the host's address if
+	// known, and give an empty span. Regexes that don't compile never
+	// match.
+
+	if len(m.Error) > 0 {
+		return nil
+	}
+
+	if m.Regex.MatchType == MatchCidr {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil
+		}
+		for _, ipnet := range m.nets {
+			if ipnet.Contains(ip) {
+				return []int{0, 0}
+			}
+		}
+		return nil
+	}
+
+	return m.re.FindStringIndex(saltid)
+}
+
+func (m Matcher) Expand(saltid string) []string {
+
+	// Return the matcher's classes for saltid with any placeholders filled
+	// in. A class is left out if one of its groups took no part in the
+	// match.
+
+	classes := []string{}
+
+	if m.re == nil {
+		// Cidr matches have no capture groups
+		for _, class := range m.Classes {
+			if !placeholder.MatchString(class) {
+				classes = append(classes, class)
+			}
+		}
+		return classes
+	}
+
+	match := m.re.FindStringSubmatchIndex(saltid)
+	if match == nil {
+		return classes
+	}
+
+	for _, class := range m.Classes {
+		ok := true
+		expanded := placeholder.ReplaceAllStringFunc(class, func(s string) string {
+			i := m.re.SubexpIndex(s[1 : len(s)-1])
+			if i < 0 || match[2*i] < 0 || match[2*i] == match[2*i+1] {
+				ok = false
+				return s
+			}
+			return saltid[match[2*i]:match[2*i+1]]
+		})
+		if ok {
+			classes = append(classes, expanded)
+		}
+	}
+
+	return classes
+}
+
+// The outcome of testing one regex against a salt id
+type RegexResult struct {
+	RegexId   int64
+	Name      string
+	Regex     string
+	MatchType string
+	Priority  int64
+	Rule      string
+	Matched   bool
+	Span      []int    // Start and end offsets of the match in the salt id
+	Classes   []string // Classes the regex included or excluded
+	Ignored   []string // Classes already decided by a higher priority regex
+	Untested  bool     // A cidr match with no address to test against
+	Error     string   // Why the regex was skipped, if it doesn't compile
+}
+
+func Evaluate(matchers []Matcher, saltid, addr string) ([]RegexResult,
+	[]string) {
+
+	// Test every matcher against saltid, and addr for cidr matches, in
+	// precedence order, and return the result for each regex along with the
+	// final list of classes.
+	//
+	// The first matching regex to mention a class decides it: an include
+	// rule adds the class and an exclude rule removes it. Lower priority
+	// regexes mentioning the same class are ignored for that class.
+	//
+	// Cidr regexes can't be tested without an address. They are marked
+	// Untested and list the undecided classes they may have included or
+	// excluded, which are left undecided. Regexes that don't compile are
+	// skipped and their result has the Error.
+
+	results := []RegexResult{}
+	classes := []string{}
+
+	decided := make(map[string]bool)
+	for i := range matchers {
+		regex := matchers[i].Regex
+		result := RegexResult{
+			RegexId:   regex.Id,
+			Name:      regex.Name,
+			Regex:     regex.Regex,
+			MatchType: regex.MatchType,
+			Priority:  regex.Priority,
+			Rule:      regex.Rule,
+			Classes:   []string{},
+			Ignored:   []string{},
+		}
+		if len(matchers[i].Error) > 0 {
+			result.Error = matchers[i].Error
+		} else if regex.MatchType == MatchCidr && net.ParseIP(addr) == nil {
+			result.Untested = true
+			for _, class := range matchers[i].Expand(saltid) {
+				if !decided[class] {
+					result.Classes = append(result.Classes, class)
+				}
+			}
+		} else if span := matchers[i].Match(saltid, addr); span != nil {
+			result.Matched = true
+			result.Span = span
+			for _, class := range matchers[i].Expand(saltid) {
+				if decided[class] {
+					result.Ignored = append(result.Ignored, class)
+					continue
+				}
+				decided[class] = true
+				result.Classes = append(result.Classes, class)
+				if result.Rule == RuleInclude {
+					classes = append(classes, class)
+				}
+			}
+		}
+		results = append(results, result)
+	}
+
+	return results, classes
+}
+
+func UntestedClasses(results []RegexResult) []string {
+
+	// Return the classes that untested cidr regexes may have included or
+	// excluded
+
+	classes := []string{}
+	for i := range results {
+		if results[i].Untested {
+			classes = append(classes, results[i].Classes...)
+		}
+	}
+
+	return classes
+}
+
+func (o HostOverride) Class() string {
+
+	// Return the override's class name, e.g. mods.ssl
+
+	if len(o.StateFile) == 0 {
+		return o.Formula
+	}
+	return o.Formula + "." + o.StateFile
+}
+
+func LoadOverrides(db *gorm.DB, dc, env string) (map[string][]HostOverride,
+	error) {
+
+	// Return the host overrides in dc and env keyed by salt id. The caller
+	// must hold the lock.
+
+	overrides := []HostOverride{}
+	if err := db.Order("id").Find(&overrides, "dc = ? and env = ?", dc,
+		env); err.Error != nil {
+		if !err.RecordNotFound() {
+			return map[string][]HostOverride{}, err.Error
+		}
+	}
+
+	byhost := make(map[string][]HostOverride)
+	for _, override := range overrides {
+		byhost[override.SaltId] = append(byhost[override.SaltId], override)
+	}
+
+	return byhost, nil
+}
+
+func ApplyOverrides(classes []string, overrides []HostOverride) ([]string,
+	[]string, []string) {
+
+	// Merge one salt id's overrides into the classes decided by the regexes.
+	// Overrides always win over the regexes. Returns the final classes, the
+	// classes added by overrides and the classes removed by overrides.
+
+	remove := make(map[string]bool)
+	for _, override := range overrides {
+		if override.Action == ActionRemove {
+			remove[override.Class()] = true
+		}
+	}
+
+	final := []string{}
+	added := []string{}
+	removed := []string{}
+
+	have := make(map[string]bool)
+	for _, class := range classes {
+		if remove[class] {
+			removed = append(removed, class)
+			continue
+		}
+		have[class] = true
+		final = append(final, class)
+	}
+
+	for _, override := range overrides {
+		class := override.Class()
+		if override.Action == ActionAdd && !have[class] {
+			have[class] = true
+			final = append(final, class)
+			added = append(added, class)
+		}
+	}
+
+	return final, added, removed
+}
+
+// ***************************************************************************
+// HOSTS
+// ***************************************************************************
+
+func KnownSaltIds(db *gorm.DB, dc, env string, extra []string) ([]string, error) {
+
+	// Return the sorted list of salt ids known in dc and env, including
+	// hosts with overrides, plus any extra ones passed in by the caller.
+	// The caller must hold the lock.
+
+	saltids := []string{}
+	if err := db.Model(Enc{}).Where("dc = ? and env = ?", dc,
+		env).Pluck("distinct salt_id", &saltids); err.Error != nil {
+		if !err.RecordNotFound() {
+			return saltids, err.Error
+		}
+	}
+	overridden := []string{}
+	if err := db.Model(HostOverride{}).Where("dc = ? and env = ?", dc,
+		env).Pluck("distinct salt_id", &overridden); err.Error != nil {
+		if !err.RecordNotFound() {
+			return saltids, err.Error
+		}
+	}
+
+	seen := make(map[string]bool)
+	hosts := []string{}
+	saltids = append(saltids, overridden...)
+	for _, saltid := range append(saltids, extra...) {
+		if len(saltid) == 0 || seen[saltid] {
+			continue
+		}
+		seen[saltid] = true
+		hosts = append(hosts, saltid)
+	}
+	sort.Strings(hosts)
+
+	return hosts, nil
+}
+
+// ***************************************************************************
+// ENC TABLE
+// ***************************************************************************
+
+func RebuildEncs(tx *gorm.DB, dc, env string, extra []string) ([]Enc,
+	error) {
+
+	// Work out the classes for every known salt id in dc and env and
+	// replace the environment's Enc rows with them, one row per class. A
+	// salt id that gets no classes keeps a single row with an empty
+	// Formula so that it is still known next time. Salt ids are all the
+	// address we have, so a host's rows are marked Untested when cidr
+	// regexes may have changed its classes.
+	//
+	// Endpoints that change regexes, classes or overrides call this with
+	// tx, the transaction making the change, so the Enc rows are saved with
+	// the change or not at all. The caller must hold the lock.
+
+	encs := []Enc{}
+
+	matchers, err := LoadMatchers(tx, dc, env)
+	if err != nil {
+		return encs, err
+	}
+
+	overrides, err := LoadOverrides(tx, dc, env)
+	if err != nil {
+		return encs, err
+	}
+
+	hosts, err := KnownSaltIds(tx, dc, env, extra)
+	if err != nil {
+		return encs, err
+	}
+
+	for _, saltid := range hosts {
+		results, classes := Evaluate(matchers, saltid, "")
+		classes, _, _ = ApplyOverrides(classes, overrides[saltid])
+		untested := len(UntestedClasses(results)) > 0
+		if len(classes) == 0 {
+			encs = append(encs, Enc{SaltId: saltid, Dc: dc, Env: env,
+				Untested: untested})
+			continue
+		}
+		for _, class := range classes {
+			parts := strings.SplitN(class, ".", 2)
+			enc := Enc{SaltId: saltid, Formula: parts[0], Dc: dc, Env: env,
+				Untested: untested}
+			if len(parts) == 2 {
+				enc.StateFile = parts[1]
+			}
+			encs = append(encs, enc)
+		}
+	}
+
+	if err := tx.Where("dc = ? and env = ?", dc, env).Delete(
+		Enc{}).Error; err != nil {
+		return encs, err
+	}
+	for i := range encs {
+		if err := tx.Create(&encs[i]).Error; err != nil {
+			return encs, err
+		}
+	}
+
+	return encs, nil
+}
+
 // ***************************************************************************
 // GO RPC PLUGIN
 // ***************************************************************************
@@ -208,11 +1123,15 @@ func (t *Plugin) GetRequest(args *Args, response *[]byte) error {
 
 	// Check if the user is allowed to access the environment
 	var err error
-	if _, err = t.GetAllowedEnv(args, env_id_str, response); err != nil {
+	var foundenv Env
+	if foundenv, err = t.GetAllowedEnv(args, env_id_str, response); err != nil {
 		// GetAllowedEnv wrote the error
 		return nil
 	}
 
+	dc := foundenv.DcSysName
+	env := foundenv.SysName
+
 	// If we get this far then the user is allowed access to this env.
 
 	// PluginDatabasePath is required to open our private db
@@ -233,18 +1152,19 @@ func (t *Plugin) GetRequest(args *Args, response *[]byte) error {
 	}
 
 	// Get Regex formula's and state files from enc tables
-	// Do we care who can get this information? I'm guessing 'no'.
 
 	db := gormInst.DB() // shortcut
 
-	// Search the regex_sls_maps table
+	// Search the regex_sls_maps table. Only maps belonging to regexes in
+	// this environment are returned.
 
 	maps := []RegexSlsMap{}
+	inenv := "regex_id in (select id from regexes where dc = ? and env = ?)"
 
 	if len(args.QueryString["regex_id"]) == 0 {
-		// No regex_id was sent. Show all maps
+		// No regex_id was sent. Show all maps for the environment
 		Lock()
-		if err := db.Find(&maps); err.Error != nil {
+		if err := db.Find(&maps, inenv, dc, env); err.Error != nil {
 			if !err.RecordNotFound() {
 				Unlock()
 				ReturnError(err.Error.Error(), response)
@@ -256,7 +1176,8 @@ func (t *Plugin) GetRequest(args *Args, response *[]byte) error {
 		// Search for a specific regex_id mapping
 		regex_id := args.QueryString["regex_id"][0]
 		Lock()
-		if err := db.Find(&maps, "regex_id = ?", regex_id); err.Error != nil {
+		if err := db.Find(&maps, "regex_id = ? and "+inenv, regex_id, dc,
+			env); err.Error != nil {
 			if !err.RecordNotFound() {
 				Unlock()
 				ReturnError(err.Error.Error(), response)
@@ -311,11 +1232,15 @@ func (t *Plugin) PostRequest(args *Args, response *[]byte) error {
 
 	// Check if the user is allowed to access the environment
 	var err error
-	if _, err = t.GetAllowedEnv(args, env_id_str, response); err != nil {
+	var foundenv Env
+	if foundenv, err = t.GetAllowedEnv(args, env_id_str, response); err != nil {
 		// GetAllowedEnv wrote the error
 		return nil
 	}
 
+	dc := foundenv.DcSysName
+	env := foundenv.SysName
+
 	// PluginDatabasePath is required to open our private db
 	if len(args.PathParams["PluginDatabasePath"]) == 0 {
 		ReturnError("Internal Error: 'PluginDatabasePath' must be set", response)
@@ -346,10 +1271,12 @@ func (t *Plugin) PostRequest(args *Args, response *[]byte) error {
 
 	db := gormInst.DB() // shortcut
 
-	// Remove all RegexSLSMap Classes (before adding)
+	// Check the regex belongs to this environment
 
+	regexes := []Regex{}
 	Lock()
-	if err := db.Where("regex_id = ?", postdata.RegexId).Delete(RegexSlsMap{}); err.Error != nil {
+	if err := db.Find(&regexes, "id = ? and dc = ? and env = ?",
+		postdata.RegexId, dc, env); err.Error != nil {
 		if !err.RecordNotFound() {
 			Unlock()
 			ReturnError(err.Error.Error(), response)
@@ -358,37 +1285,138 @@ func (t *Plugin) PostRequest(args *Args, response *[]byte) error {
 	}
 	Unlock()
 
-	// Add the ENC classes
+	if len(regexes) == 0 {
+		id := strconv.FormatInt(postdata.RegexId, 10)
+		ReturnError("Regex Id:"+id+" not found", response)
+		return nil
+	}
+
+	re, err := MatchRegexp(regexes[0])
+	if err != nil {
+		ReturnError("Regex Id:"+strconv.FormatInt(postdata.RegexId, 10)+
+			" does not compile: "+err.Error(), response)
+		return nil
+	}
+
+	// Work out the ENC classes to add
+
+	maps := []RegexSlsMap{}
+	seen := make(map[string]bool)
 
 	for i := range postdata.Classes {
-		classes := strings.Split(postdata.Classes[i], ".")
-		formula := ""
-		statefile := ""
-		switch len(classes) {
-		case 0:
+		regexmap, err := ParseClass(postdata.Classes[i])
+		if err != nil {
+			ReturnError(err.Error(), response)
+			return nil
+		}
+		if err := CheckPlaceholders(postdata.Classes[i], re); err != nil {
+			ReturnError(err.Error(), response)
+			return nil
+		}
+		if seen[regexmap.Formula+"."+regexmap.StateFile] {
 			continue
-		case 1:
-			formula = classes[0]
-		case 2:
-			formula = classes[0]
-			statefile = classes[1]
-		}
-		regexmap := RegexSlsMap{
-			Id:        0,
-			Formula:   formula,
-			StateFile: statefile,
-			RegexId:   postdata.RegexId,
 		}
-		Lock()
-		if err := db.Create(&regexmap); err.Error != nil {
+		seen[regexmap.Formula+"."+regexmap.StateFile] = true
+		regexmap.RegexId = postdata.RegexId
+		maps = append(maps, regexmap)
+	}
+
+	// The classes being replaced, for the audit trail
+
+	oldmaps := []RegexSlsMap{}
+	Lock()
+	if err := db.Find(&oldmaps, "regex_id = ?", postdata.RegexId); err.Error != nil {
+		if !err.RecordNotFound() {
 			Unlock()
 			ReturnError(err.Error.Error(), response)
 			return nil
 		}
+	}
+	Unlock()
+
+	before := []string{}
+	for _, m := range oldmaps {
+		before = append(before, m.Class())
+	}
+	after := []string{}
+	for _, m := range maps {
+		after = append(after, m.Class())
+	}
+
+	audit := Audit{
+		Login:   args.PathParams["login"],
+		Dc:      dc,
+		Env:     env,
+		Action:  AuditUpdate,
+		Kind:    AuditClasses,
+		RegexId: postdata.RegexId,
+	}
+
+	// Remove all RegexSLSMap Classes and add the new ones, with the audit
+	// record and a new revision, in a single transaction so a failure
+	// leaves the previous classes in place
+
+	Lock()
+	tx := db.Begin()
+	if err := FirstRevision(tx, audit); err != nil {
+		tx.Rollback()
 		Unlock()
+		ReturnError("Revision error: "+err.Error(), response)
+		return nil
+	}
+	if err := tx.Where("regex_id = ?", postdata.RegexId).Delete(RegexSlsMap{}); err.Error != nil {
+		if !err.RecordNotFound() {
+			tx.Rollback()
+			Unlock()
+			ReturnError(err.Error.Error(), response)
+			return nil
+		}
 	}
 
-	reply := Reply{0, "", SUCCESS, ""}
+	for i := range maps {
+		if err := tx.Create(&maps[i]); err.Error != nil {
+			tx.Rollback()
+			Unlock()
+			ReturnError(err.Error.Error(), response)
+			return nil
+		}
+	}
+
+	if err := WriteAudit(tx, audit, before, after); err != nil {
+		tx.Rollback()
+		Unlock()
+		ReturnError("Audit error: "+err.Error(), response)
+		return nil
+	}
+
+	if err := WriteRevision(tx, audit,
+		"Changed the classes of regex '"+regexes[0].Name+"'"); err != nil {
+		tx.Rollback()
+		Unlock()
+		ReturnError("Revision error: "+err.Error(), response)
+		return nil
+	}
+	if _, err := RebuildEncs(tx, dc, env, []string{}); err != nil {
+		tx.Rollback()
+		Unlock()
+		ReturnError("Enc rebuild error: "+err.Error(), response)
+		return nil
+	}
+	if err := tx.Commit(); err.Error != nil {
+		Unlock()
+		ReturnError(err.Error.Error(), response)
+		return nil
+	}
+	Unlock()
+
+	// Output the new maps as JSON
+
+	TempJsonData, err := json.Marshal(maps)
+	if err != nil {
+		ReturnError("Marshal error: "+err.Error(), response)
+		return nil
+	}
+	reply := Reply{0, string(TempJsonData), SUCCESS, ""}
 	jsondata, err := json.Marshal(reply)
 
 	if err != nil {
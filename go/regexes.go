@@ -24,8 +24,13 @@ import (
 	"net"
 	"net/rpc"
 	"os"
+	"regexp"
+	"regexp/syntax"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
 )
 
 // ***************************************************************************
@@ -39,22 +44,72 @@ type Enc struct {
 	StateFile string // Sls file name
 	Dc        string // Data centre name
 	Env       string // Environment name
+	Untested  bool   // Cidr regexes that may give classes were not tested
 }
 
 type Regex struct {
-	Id    int64
-	Regex string // The regular expression
-	Dc    string // Data centre name
-	Env   string // Environment name
-	Name  string // Short name for the regex, no spaces
-	Desc  string // Description of the regex
+	Id         int64
+	Regex      string // The regular expression
+	Dc         string // Data centre name
+	Env        string // Environment name
+	Name       string // Short name for the regex, no spaces
+	Desc       string // Description of the regex
+	Priority   int64  // Higher priority regexes take precedence
+	Rule       string // "include" (or empty) adds classes, "exclude" removes
+	MatchType  string // "pcre" (or empty), "glob", "list" or "cidr"
+	IgnoreCase bool   // Match salt ids case insensitively
+	FullMatch  bool   // A pcre regex must match the whole salt id
 }
 
+const (
+	RuleInclude = "include"
+	RuleExclude = "exclude"
+)
+
 type RegexSlsMap struct {
 	Id        int64
 	RegexId   int64  // Not null
 	Formula   string // Not null
-	StateFile string // Can be null
+	StateFile string // Can be null, dotted if nested, e.g. mods.ssl
+}
+
+type HostOverride struct {
+	Id        int64
+	SaltId    string // Name of the server
+	Formula   string // Not null
+	StateFile string // Can be null, dotted if nested, e.g. mods.ssl
+	Action    string // "add" or "remove" the class
+	Dc        string // Data centre name
+	Env       string // Environment name
+}
+
+const (
+	ActionAdd    = "add"
+	ActionRemove = "remove"
+)
+
+type Audit struct {
+	Id      int64
+	Login   string    // Who made the change
+	Time    time.Time // When the change was saved, in UTC
+	Dc      string    // Data centre name
+	Env     string    // Environment name
+	Action  string    // "create", "update" or "delete"
+	Kind    string    // "regex" or "classes"
+	RegexId int64     // The regex that changed, or whose classes changed
+	Before  string    // JSON of the values before, empty if created
+	After   string    // JSON of the values after, empty if deleted
+}
+
+type Revision struct {
+	Id       int64
+	Dc       string    // Data centre name
+	Env      string    // Environment name
+	Number   int64     // Counts up from 1 in each environment
+	Login    string    // Who made the change
+	Time     time.Time // When the change was saved, in UTC
+	Reason   string    // What changed
+	Snapshot string    // JSON of the regexes and their classes afterwards
 }
 
 // --
@@ -67,109 +122,1084 @@ type Config struct {
 	Port     int
 }
 
-func (c *Config) DBPath() string {
+func (c *Config) DBPath() string {
+
+	return c.Dbname
+}
+
+func (c *Config) SetDBPath(path string) {
+
+	c.Dbname = path
+}
+
+func NewConfig() {
+
+	config = &Config{}
+}
+
+// --
+
+type GormDB struct {
+	db gorm.DB
+}
+
+func (gormInst *GormDB) InitDB() error {
+
+	var err error
+	dbname := config.DBPath()
+
+	gormInst.db, err = gorm.Open("sqlite3", dbname+"enc.db")
+	if err != nil {
+		return ApiError{"Open " + dbname + " failed. " + err.Error()}
+	}
+
+	if err := gormInst.db.AutoMigrate(Enc{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate Enc table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(Regex{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate Regex table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(RegexSlsMap{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate RegexSlsMap table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(HostOverride{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate HostOverride table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(Audit{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate Audit table failed: %s", err)
+		return ApiError{txt}
+	}
+	if err := gormInst.db.AutoMigrate(Revision{}).Error; err != nil {
+		txt := fmt.Sprintf("AutoMigrate Revision table failed: %s", err)
+		return ApiError{txt}
+	}
+
+	// Unique index is also a constraint, so are forced to be unique
+	gormInst.db.Model(Enc{}).AddIndex("idx_enc_salt_id", "salt_id")
+	gormInst.db.Model(HostOverride{}).AddIndex("idx_host_override_salt_id",
+		"salt_id")
+	gormInst.db.Model(Audit{}).AddIndex("idx_audit_dc_env", "dc", "env")
+	gormInst.db.Model(Revision{}).AddIndex("idx_revision_dc_env", "dc", "env")
+
+	return nil
+}
+
+func (gormInst *GormDB) DB() *gorm.DB {
+
+	return &gormInst.db
+}
+
+func NewDB() (*GormDB, error) {
+
+	gormInst := &GormDB{}
+	if err := gormInst.InitDB(); err != nil {
+		return gormInst, err
+	}
+	return gormInst, nil
+}
+
+// ***************************************************************************
+// PORT LOCKING
+// ***************************************************************************
+
+// PortLock is a locker which locks by binding to a port on the loopback IPv4
+// interface
+type PortLock struct {
+	hostport string
+	ln       net.Listener
+}
+
+func NewPortLock(port int) *PortLock {
+
+	// NewFLock creates new Flock-based lock (unlocked first)
+	return &PortLock{hostport: net.JoinHostPort("127.0.0.1", strconv.Itoa(port))}
+}
+
+func (p *PortLock) Lock() {
+
+	// Lock acquires the lock, blocking
+	t := 50 * time.Millisecond
+	for {
+		if l, err := net.Listen("tcp", p.hostport); err == nil {
+			p.ln = l // thanks to zhangpy
+			return
+		}
+		//log.Printf("spinning lock on %s (%s)", p.hostport, err)
+		time.Sleep(t)
+		//t = time.Duration(
+		//  math.Min( float64(time.Duration(float32(t) * 1.5)), 2000 ))
+	}
+}
+
+func (p *PortLock) Unlock() {
+
+	// Unlock releases the lock
+	if p.ln != nil {
+		p.ln.Close()
+	}
+}
+
+// ***************************************************************************
+// MATCH TYPES
+// ***************************************************************************
+
+const (
+	MatchPcre = "pcre" // A regular expression, the default
+	MatchGlob = "glob" // A shell style glob, e.g. web*
+	MatchList = "list" // A comma separated list of salt ids
+	MatchCidr = "cidr" // Comma separated networks matched against the address
+)
+
+func GlobToRegex(glob string) string {
+
+	// Convert a shell style glob, as used by Salt's glob matcher, to an
+	// anchored regex
+
+	expr := "^"
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			expr += ".*"
+		case '?':
+			expr += "."
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				expr += regexp.QuoteMeta(string(c))
+				continue
+			}
+			// fnmatch negates a set with !, and a ^ in it is just a ^
+			set := strings.Replace(glob[i+1:i+1+end], `\`, `\\`, -1)
+			if strings.HasPrefix(set, "!") {
+				set = "^" + set[1:]
+			} else if strings.HasPrefix(set, "^") {
+				set = `\` + set
+			}
+			expr += "[" + set + "]"
+			i += end + 1
+		default:
+			expr += regexp.QuoteMeta(string(c))
+		}
+	}
+
+	return expr + "$"
+}
+
+func SplitList(list string) []string {
+
+	// Return the non-empty items of a comma separated list
+
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func ListToRegex(list string) string {
+
+	// Convert a comma separated list of salt ids to an anchored regex
+
+	saltids := SplitList(list)
+	for i := range saltids {
+		saltids[i] = regexp.QuoteMeta(saltids[i])
+	}
+
+	return "^(?:" + strings.Join(saltids, "|") + ")$"
+}
+
+func ParseNets(cidrs string) ([]*net.IPNet, error) {
+
+	// Parse a comma separated list of networks, e.g. 10.1.0.0/16, or single
+	// addresses
+
+	nets := []*net.IPNet{}
+	for _, cidr := range SplitList(cidrs) {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nets, ApiError{"'" + cidr + "' is not an address or network"}
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nets, ApiError{"'" + cidr + "' is not an address or network"}
+		}
+		nets = append(nets, ipnet)
+	}
+
+	if len(nets) == 0 {
+		return nets, ApiError{"no networks given"}
+	}
+
+	return nets, nil
+}
+
+func MatchExpr(regex Regex) string {
+
+	// Return the regex that salt ids are tested against for a pcre, glob or
+	// list match, with the regex's IgnoreCase and FullMatch flags applied
+
+	expr := regex.Regex
+	switch regex.MatchType {
+	case MatchGlob:
+		expr = GlobToRegex(expr)
+	case MatchList:
+		expr = ListToRegex(expr)
+	default:
+		if regex.FullMatch {
+			expr = "^(?:" + expr + ")$"
+		}
+	}
+	if regex.IgnoreCase {
+		expr = "(?i)" + expr
+	}
+
+	return expr
+}
+
+func MatchRegexp(regex Regex) (*regexp.Regexp, error) {
+
+	// Return the compiled regex that salt ids are tested against for any
+	// match type. Cidr matches test the host's address instead so have no
+	// regex.
+
+	if regex.MatchType == MatchCidr {
+		_, err := ParseNets(regex.Regex)
+		return nil, err
+	}
+
+	return regexp.Compile(MatchExpr(regex))
+}
+
+// ***************************************************************************
+// VALIDATION
+// ***************************************************************************
+
+const (
+	MaxNameLength  = 64
+	MaxRegexLength = 1024
+)
+
+// Details of a field that failed validation. Position is the offset of the
+// problem within the field, or -1 if it applies to the whole field.
+type ValidationError struct {
+	Field    string
+	Value    string
+	Reason   string
+	Position int
+}
+
+func (e ValidationError) Error() string {
+
+	if e.Position >= 0 {
+		return fmt.Sprintf("Invalid %s '%s': %s (at position %d)", e.Field,
+			e.Value, e.Reason, e.Position)
+	}
+	return fmt.Sprintf("Invalid %s '%s': %s", e.Field, e.Value, e.Reason)
+}
+
+func ReturnValidationError(verr ValidationError, response *[]byte) {
+
+	// Like ReturnError but the details are also sent, as JSON, in Text
+
+	details, _ := json.Marshal(verr)
+	errtext := Reply{0, string(details), ERROR, verr.Error()}
+	logit(verr.Error())
+	jsondata, _ := json.Marshal(errtext)
+	*response = jsondata
+}
+
+func ValidateRegex(postdata PostedData) *ValidationError {
+
+	// Check the posted regex can be saved
+
+	name := postdata.Name
+	if len(name) == 0 {
+		return &ValidationError{"Name", name, "must be set", -1}
+	}
+	if len(name) > MaxNameLength {
+		return &ValidationError{"Name", name,
+			fmt.Sprintf("must be at most %d characters", MaxNameLength), -1}
+	}
+	if pos := strings.IndexFunc(name, unicode.IsSpace); pos >= 0 {
+		return &ValidationError{"Name", name, "must not contain spaces", pos}
+	}
+
+	matchtype := postdata.MatchType
+	if len(matchtype) == 0 {
+		matchtype = MatchPcre
+	}
+	switch matchtype {
+	case MatchPcre, MatchGlob, MatchList, MatchCidr:
+	default:
+		return &ValidationError{"MatchType", matchtype, "must be one of '" +
+			strings.Join([]string{MatchPcre, MatchGlob, MatchList, MatchCidr},
+				"', '") + "'", -1}
+	}
+
+	expr := postdata.Regex
+	if len(expr) == 0 {
+		return &ValidationError{"Regex", expr, "must be set", -1}
+	}
+	if len(expr) > MaxRegexLength {
+		return &ValidationError{"Regex", expr,
+			fmt.Sprintf("must be at most %d characters", MaxRegexLength), -1}
+	}
+	if matchtype == MatchGlob {
+		if pos := strings.IndexFunc(expr, unicode.IsSpace); pos >= 0 {
+			return &ValidationError{"Regex", expr, "must not contain spaces", pos}
+		}
+	}
+	if matchtype == MatchList {
+		for _, saltid := range SplitList(expr) {
+			if strings.IndexFunc(saltid, unicode.IsSpace) >= 0 {
+				return &ValidationError{"Regex", expr,
+					"salt ids must not contain spaces", strings.Index(expr, saltid)}
+			}
+		}
+	}
+	if _, err := MatchRegexp(Regex{Regex: expr, MatchType: matchtype}); err != nil {
+		if serr, ok := err.(*syntax.Error); ok && matchtype == MatchPcre {
+			return &ValidationError{"Regex", expr,
+				serr.Code.String() + ": `" + serr.Expr + "`",
+				strings.Index(expr, serr.Expr)}
+		}
+		return &ValidationError{"Regex", expr, err.Error(), -1}
+	}
+
+	rule := postdata.Rule
+	if len(rule) > 0 && rule != RuleInclude && rule != RuleExclude {
+		return &ValidationError{"Rule", rule,
+			"must be '" + RuleInclude + "' or '" + RuleExclude + "'", -1}
+	}
+
+	return nil
+}
+
+// A placeholder in a class, e.g. the {role} in app.{role}, filled from the
+// regex's named capture group of the same name
+var placeholder = regexp.MustCompile(`\{(\w+)\}`)
+
+func (m RegexSlsMap) Class() string {
+
+	// The class name as written in a top file, formula or formula.statefile
+
+	if len(m.StateFile) > 0 {
+		return m.Formula + "." + m.StateFile
+	}
+	return m.Formula
+}
+
+func CheckNameUnique(db *gorm.DB, dc, env, name string,
+	id int64) (*ValidationError, error) {
+
+	// Check that no other regex in dc and env has the name, since regexes
+	// are matched by name when environments are compared, promoted or
+	// imported. id is the regex being changed, or 0 for a new one. The
+	// caller must hold the lock.
+
+	regexes := []Regex{}
+	if err := db.Find(&regexes, "dc = ? and env = ? and name = ? and id <> ?",
+		dc, env, name, id); err.Error != nil {
+		if !err.RecordNotFound() {
+			return nil, err.Error
+		}
+	}
+
+	if len(regexes) > 0 {
+		return &ValidationError{"Name", name, fmt.Sprintf(
+			"is already used by regex Id:%d", regexes[0].Id), -1}, nil
+	}
+
+	return nil, nil
+}
+
+func ValidatePlaceholders(postdata PostedData,
+	maps []RegexSlsMap) *ValidationError {
+
+	// Check a changed regex still has the capture groups its classes use
+
+	re, err := MatchRegexp(Regex{Regex: postdata.Regex,
+		MatchType: postdata.MatchType})
+	if err != nil {
+		return &ValidationError{"Regex", postdata.Regex, err.Error(), -1}
+	}
+
+	for _, m := range maps {
+		class := m.Class()
+		for _, p := range placeholder.FindAllStringSubmatch(class, -1) {
+			if re == nil || re.SubexpIndex(p[1]) < 0 {
+				return &ValidationError{"Regex", postdata.Regex,
+					"no capture group named '" + p[1] + "', used by class '" +
+						class + "'", -1}
+			}
+		}
+	}
+
+	return nil
+}
+
+// ***************************************************************************
+// AUDIT
+// ***************************************************************************
+
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+const (
+	AuditRegex   = "regex"
+	AuditClasses = "classes"
+)
+
+func WriteAudit(tx *gorm.DB, audit Audit, before, after interface{}) error {
+
+	// Save an audit record with tx, the transaction making the change, so
+	// the change and its record are saved together or not at all. before
+	// and after are stored as JSON, nil meaning there was nothing.
+
+	audit.Time = time.Now().UTC()
+
+	if before != nil {
+		b, err := json.Marshal(before)
+		if err != nil {
+			return err
+		}
+		audit.Before = string(b)
+	}
+
+	if after != nil {
+		a, err := json.Marshal(after)
+		if err != nil {
+			return err
+		}
+		audit.After = string(a)
+	}
+
+	return tx.Create(&audit).Error
+}
+
+func NextRegexId(tx *gorm.DB) (int64, error) {
+
+	// Return an Id that no regex has had before. SQLite hands out the
+	// highest rowid again once that row is deleted, which would give a new
+	// regex the old one's orphaned classes and audit history, so Ids still
+	// used in the regex_sls_maps or audits tables are skipped too. The
+	// caller must hold the lock.
+
+	var id int64
+	if err := tx.Raw("select coalesce(max(id), 0) from (" +
+		"select max(id) as id from regexes union " +
+		"select max(regex_id) from regex_sls_maps union " +
+		"select max(regex_id) from audits)").Row().Scan(&id); err != nil {
+		return 0, err
+	}
+
+	return id + 1, nil
+}
+
+// ***************************************************************************
+// REVISIONS
+// ***************************************************************************
+
+// A regex and its classes as kept in a revision
+type SnapshotRegex struct {
+	Regex   Regex
+	Classes []string
+}
+
+func Snapshot(db *gorm.DB, dc, env string) ([]SnapshotRegex, error) {
+
+	// Return the regexes in dc and env, in precedence order, with their
+	// classes. It doesn't lock so that it can be used in a transaction; the
+	// caller must hold the lock.
+
+	snapshot := []SnapshotRegex{}
+
+	regexes := []Regex{}
+	if err := db.Order("priority desc, id").Find(&regexes, "dc = ? and env = ?",
+		dc, env); err.Error != nil {
+		if !err.RecordNotFound() {
+			return snapshot, err.Error
+		}
+	}
+
+	ids := []int64{}
+	for i := range regexes {
+		ids = append(ids, regexes[i].Id)
+	}
+
+	maps := []RegexSlsMap{}
+	if len(ids) > 0 {
+		if err := db.Order("id").Where("regex_id in (?)", ids).Find(
+			&maps); err.Error != nil {
+			if !err.RecordNotFound() {
+				return snapshot, err.Error
+			}
+		}
+	}
+
+	classes := make(map[int64][]string)
+	for _, m := range maps {
+		// Older versions saved blank classes, which give no state
+		if len(strings.TrimSpace(m.Class())) == 0 {
+			continue
+		}
+		classes[m.RegexId] = append(classes[m.RegexId], m.Class())
+	}
+
+	for i := range regexes {
+		snapshotregex := SnapshotRegex{regexes[i], classes[regexes[i].Id]}
+		if snapshotregex.Classes == nil {
+			snapshotregex.Classes = []string{}
+		}
+		snapshot = append(snapshot, snapshotregex)
+	}
+
+	return snapshot, nil
+}
+
+func LatestRevision(db *gorm.DB, dc, env string) (int64, error) {
+
+	// Return the newest revision number in dc and env, or 0 if there are
+	// none. The caller must hold the lock.
+
+	revisions := []Revision{}
+	if err := db.Order("number desc").Limit(1).Find(&revisions,
+		"dc = ? and env = ?", dc, env); err.Error != nil {
+		if !err.RecordNotFound() {
+			return 0, err.Error
+		}
+	}
+
+	if len(revisions) == 0 {
+		return 0, nil
+	}
+
+	return revisions[0].Number, nil
+}
+
+func WriteRevision(tx *gorm.DB, audit Audit, reason string) error {
+
+	// Save the regexes and classes in the audit record's environment, as
+	// they are in tx, as the next revision
+
+	number, err := LatestRevision(tx, audit.Dc, audit.Env)
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := Snapshot(tx, audit.Dc, audit.Env)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	revision := Revision{
+		Dc:       audit.Dc,
+		Env:      audit.Env,
+		Number:   number + 1,
+		Login:    audit.Login,
+		Time:     time.Now().UTC(),
+		Reason:   reason,
+		Snapshot: string(data),
+	}
+
+	return tx.Create(&revision).Error
+}
+
+func FirstRevision(tx *gorm.DB, audit Audit) error {
+
+	// Environments changed before revisions were kept have none, so save
+	// them as they are as the first revision. This must be called before tx
+	// changes anything.
+
+	number, err := LatestRevision(tx, audit.Dc, audit.Env)
+	if err != nil || number > 0 {
+		return err
+	}
+
+	return WriteRevision(tx, audit, "Configuration before revisions were kept")
+}
+
+// ***************************************************************************
+// CLASSIFICATION
+// ***************************************************************************
+
+func LoadRegexes(db *gorm.DB, dc, env string) ([]Regex, error) {
+
+	// Return all regexes for an environment in precedence order, highest
+	// priority first. Regexes with the same priority are in the order they
+	// were added. The caller must hold the lock.
+
+	regexes := []Regex{}
+	if err := db.Order("priority desc, id").Find(&regexes,
+		"dc = ? and env = ?", dc, env); err.Error != nil {
+		if !err.RecordNotFound() {
+			return regexes, err.Error
+		}
+	}
+
+	return regexes, nil
+}
+
+func LoadMaps(db *gorm.DB, regexes []Regex) (map[int64][]RegexSlsMap, error) {
+
+	// Return the RegexSlsMaps for each regex, keyed by RegexId. The caller
+	// must hold the lock.
+
+	maps := make(map[int64][]RegexSlsMap)
+	if len(regexes) == 0 {
+		return maps, nil
+	}
+
+	ids := []int64{}
+	for i := range regexes {
+		ids = append(ids, regexes[i].Id)
+	}
+
+	rows := []RegexSlsMap{}
+	if err := db.Order("id").Find(&rows, "regex_id in (?)", ids); err.Error != nil {
+		if !err.RecordNotFound() {
+			return maps, err.Error
+		}
+	}
+
+	for i := range rows {
+		maps[rows[i].RegexId] = append(maps[rows[i].RegexId], rows[i])
+	}
+
+	return maps, nil
+}
+
+// A regex compiled and ready to be tested against salt ids
+type Matcher struct {
+	Regex   Regex
+	Classes []string // Classes from the regex's RegexSlsMaps
+	Error   string   // Why the regex can't be used, empty if it can
+	re      *regexp.Regexp
+	nets    []*net.IPNet // Networks for cidr matches
+}
+
+func NewMatchers(regexes []Regex,
+	maps map[int64][]RegexSlsMap) []Matcher {
+
+	// Compile each regex and gather its classes. The order of regexes is
+	// kept. Regexes saved before they were validated may not compile. They
+	// are logged and kept with their Error set, so they can be reported,
+	// but never match.
+
+	matchers := []Matcher{}
+
+	for i := range regexes {
+		re, err := MatchRegexp(regexes[i])
+		matcher := Matcher{
+			Regex:   regexes[i],
+			Classes: []string{},
+			re:      re,
+		}
+		if err != nil {
+			txt := fmt.Sprintf("Regex '%s' (Id:%d) does not compile: %s",
+				regexes[i].Name, regexes[i].Id, err.Error())
+			logit(txt)
+			matcher.Error = err.Error()
+		}
+		if len(matcher.Regex.Rule) == 0 {
+			matcher.Regex.Rule = RuleInclude
+		}
+		if len(matcher.Regex.MatchType) == 0 {
+			matcher.Regex.MatchType = MatchPcre
+		}
+		if matcher.Regex.MatchType == MatchCidr {
+			matcher.nets, _ = ParseNets(regexes[i].Regex)
+		}
+		for _, m := range maps[regexes[i].Id] {
+			if class := m.Class(); len(class) > 0 {
+				matcher.Classes = append(matcher.Classes, class)
+			}
+		}
+		matchers = append(matchers, matcher)
+	}
+
+	return matchers
+}
+
+func LoadMatchers(db *gorm.DB, dc, env string) ([]Matcher, error) {
+
+	// Return matchers for all regexes in dc and env, in precedence order.
+	// The caller must hold the lock.
+
+	regexes, err := LoadRegexes(db, dc, env)
+	if err != nil {
+		return []Matcher{}, err
+	}
+
+	maps, err := LoadMaps(db, regexes)
+	if err != nil {
+		return []Matcher{}, err
+	}
+
+	return NewMatchers(regexes, maps), nil
+}
+
+func (m Matcher) Match(saltid, addr string) []int {
+
+	// Return the start and end offsets of the match in saltid, or nil if
+	// there is no match. Cidr matches test addr, the host's address if
+	// known, and give an empty span. Regexes that don't compile never
+	// match.
+
+	if len(m.Error) > 0 {
+		return nil
+	}
+
+	if m.Regex.MatchType == MatchCidr {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil
+		}
+		for _, ipnet := range m.nets {
+			if ipnet.Contains(ip) {
+				return []int{0, 0}
+			}
+		}
+		return nil
+	}
+
+	return m.re.FindStringIndex(saltid)
+}
+
+func (m Matcher) Expand(saltid string) []string {
+
+	// Return the matcher's classes for saltid with any placeholders filled
+	// in. A class is left out if one of its groups took no part in the
+	// match.
+
+	classes := []string{}
+
+	if m.re == nil {
+		// Cidr matches have no capture groups
+		for _, class := range m.Classes {
+			if !placeholder.MatchString(class) {
+				classes = append(classes, class)
+			}
+		}
+		return classes
+	}
+
+	match := m.re.FindStringSubmatchIndex(saltid)
+	if match == nil {
+		return classes
+	}
+
+	for _, class := range m.Classes {
+		ok := true
+		expanded := placeholder.ReplaceAllStringFunc(class, func(s string) string {
+			i := m.re.SubexpIndex(s[1 : len(s)-1])
+			if i < 0 || match[2*i] < 0 || match[2*i] == match[2*i+1] {
+				ok = false
+				return s
+			}
+			return saltid[match[2*i]:match[2*i+1]]
+		})
+		if ok {
+			classes = append(classes, expanded)
+		}
+	}
+
+	return classes
+}
+
+// The outcome of testing one regex against a salt id
+type RegexResult struct {
+	RegexId   int64
+	Name      string
+	Regex     string
+	MatchType string
+	Priority  int64
+	Rule      string
+	Matched   bool
+	Span      []int    // Start and end offsets of the match in the salt id
+	Classes   []string // Classes the regex included or excluded
+	Ignored   []string // Classes already decided by a higher priority regex
+	Untested  bool     // A cidr match with no address to test against
+	Error     string   // Why the regex was skipped, if it doesn't compile
+}
+
+func Evaluate(matchers []Matcher, saltid, addr string) ([]RegexResult,
+	[]string) {
+
+	// Test every matcher against saltid, and addr for cidr matches, in
+	// precedence order, and return the result for each regex along with the
+	// final list of classes.
+	//
+	// The first matching regex to mention a class decides it: an include
+	// rule adds the class and an exclude rule removes it. Lower priority
+	// regexes mentioning the same class are ignored for that class.
+	//
+	// Cidr regexes can't be tested without an address. They are marked
+	// Untested and list the undecided classes they may have included or
+	// excluded, which are left undecided. Regexes that don't compile are
+	// skipped and their result has the Error.
+
+	results := []RegexResult{}
+	classes := []string{}
+
+	decided := make(map[string]bool)
+	for i := range matchers {
+		regex := matchers[i].Regex
+		result := RegexResult{
+			RegexId:   regex.Id,
+			Name:      regex.Name,
+			Regex:     regex.Regex,
+			MatchType: regex.MatchType,
+			Priority:  regex.Priority,
+			Rule:      regex.Rule,
+			Classes:   []string{},
+			Ignored:   []string{},
+		}
+		if len(matchers[i].Error) > 0 {
+			result.Error = matchers[i].Error
+		} else if regex.MatchType == MatchCidr && net.ParseIP(addr) == nil {
+			result.Untested = true
+			for _, class := range matchers[i].Expand(saltid) {
+				if !decided[class] {
+					result.Classes = append(result.Classes, class)
+				}
+			}
+		} else if span := matchers[i].Match(saltid, addr); span != nil {
+			result.Matched = true
+			result.Span = span
+			for _, class := range matchers[i].Expand(saltid) {
+				if decided[class] {
+					result.Ignored = append(result.Ignored, class)
+					continue
+				}
+				decided[class] = true
+				result.Classes = append(result.Classes, class)
+				if result.Rule == RuleInclude {
+					classes = append(classes, class)
+				}
+			}
+		}
+		results = append(results, result)
+	}
 
-	return c.Dbname
+	return results, classes
 }
 
-func (c *Config) SetDBPath(path string) {
+func UntestedClasses(results []RegexResult) []string {
 
-	c.Dbname = path
-}
+	// Return the classes that untested cidr regexes may have included or
+	// excluded
 
-func NewConfig() {
+	classes := []string{}
+	for i := range results {
+		if results[i].Untested {
+			classes = append(classes, results[i].Classes...)
+		}
+	}
 
-	config = &Config{}
+	return classes
 }
 
-// --
+func (o HostOverride) Class() string {
 
-type GormDB struct {
-	db gorm.DB
+	// Return the override's class name, e.g. mods.ssl
+
+	if len(o.StateFile) == 0 {
+		return o.Formula
+	}
+	return o.Formula + "." + o.StateFile
 }
 
-func (gormInst *GormDB) InitDB() error {
+func LoadOverrides(db *gorm.DB, dc, env string) (map[string][]HostOverride,
+	error) {
 
-	var err error
-	dbname := config.DBPath()
+	// Return the host overrides in dc and env keyed by salt id. The caller
+	// must hold the lock.
 
-	gormInst.db, err = gorm.Open("sqlite3", dbname+"enc.db")
-	if err != nil {
-		return ApiError{"Open " + dbname + " failed. " + err.Error()}
+	overrides := []HostOverride{}
+	if err := db.Order("id").Find(&overrides, "dc = ? and env = ?", dc,
+		env); err.Error != nil {
+		if !err.RecordNotFound() {
+			return map[string][]HostOverride{}, err.Error
+		}
 	}
 
-	if err := gormInst.db.AutoMigrate(Enc{}).Error; err != nil {
-		txt := fmt.Sprintf("AutoMigrate Enc table failed: %s", err)
-		return ApiError{txt}
+	byhost := make(map[string][]HostOverride)
+	for _, override := range overrides {
+		byhost[override.SaltId] = append(byhost[override.SaltId], override)
 	}
-	if err := gormInst.db.AutoMigrate(Regex{}).Error; err != nil {
-		txt := fmt.Sprintf("AutoMigrate Regex table failed: %s", err)
-		return ApiError{txt}
+
+	return byhost, nil
+}
+
+func ApplyOverrides(classes []string, overrides []HostOverride) ([]string,
+	[]string, []string) {
+
+	// Merge one salt id's overrides into the classes decided by the regexes.
+	// Overrides always win over the regexes. Returns the final classes, the
+	// classes added by overrides and the classes removed by overrides.
+
+	remove := make(map[string]bool)
+	for _, override := range overrides {
+		if override.Action == ActionRemove {
+			remove[override.Class()] = true
+		}
 	}
-	if err := gormInst.db.AutoMigrate(RegexSlsMap{}).Error; err != nil {
-		txt := fmt.Sprintf("AutoMigrate RegexSlsMap table failed: %s", err)
-		return ApiError{txt}
+
+	final := []string{}
+	added := []string{}
+	removed := []string{}
+
+	have := make(map[string]bool)
+	for _, class := range classes {
+		if remove[class] {
+			removed = append(removed, class)
+			continue
+		}
+		have[class] = true
+		final = append(final, class)
 	}
 
-	// Unique index is also a constraint, so are forced to be unique
-	gormInst.db.Model(Enc{}).AddIndex("idx_enc_salt_id", "salt_id")
+	for _, override := range overrides {
+		class := override.Class()
+		if override.Action == ActionAdd && !have[class] {
+			have[class] = true
+			final = append(final, class)
+			added = append(added, class)
+		}
+	}
 
-	return nil
+	return final, added, removed
 }
 
-func (gormInst *GormDB) DB() *gorm.DB {
+// ***************************************************************************
+// HOSTS
+// ***************************************************************************
 
-	return &gormInst.db
-}
+func KnownSaltIds(db *gorm.DB, dc, env string, extra []string) ([]string, error) {
 
-func NewDB() (*GormDB, error) {
+	// Return the sorted list of salt ids known in dc and env, including
+	// hosts with overrides, plus any extra ones passed in by the caller.
+	// The caller must hold the lock.
 
-	gormInst := &GormDB{}
-	if err := gormInst.InitDB(); err != nil {
-		return gormInst, err
+	saltids := []string{}
+	if err := db.Model(Enc{}).Where("dc = ? and env = ?", dc,
+		env).Pluck("distinct salt_id", &saltids); err.Error != nil {
+		if !err.RecordNotFound() {
+			return saltids, err.Error
+		}
 	}
-	return gormInst, nil
+	overridden := []string{}
+	if err := db.Model(HostOverride{}).Where("dc = ? and env = ?", dc,
+		env).Pluck("distinct salt_id", &overridden); err.Error != nil {
+		if !err.RecordNotFound() {
+			return saltids, err.Error
+		}
+	}
+
+	seen := make(map[string]bool)
+	hosts := []string{}
+	saltids = append(saltids, overridden...)
+	for _, saltid := range append(saltids, extra...) {
+		if len(saltid) == 0 || seen[saltid] {
+			continue
+		}
+		seen[saltid] = true
+		hosts = append(hosts, saltid)
+	}
+	sort.Strings(hosts)
+
+	return hosts, nil
 }
 
 // ***************************************************************************
-// PORT LOCKING
+// ENC TABLE
 // ***************************************************************************
 
-// PortLock is a locker which locks by binding to a port on the loopback IPv4
-// interface
-type PortLock struct {
-	hostport string
-	ln       net.Listener
-}
+func RebuildEncs(tx *gorm.DB, dc, env string, extra []string) ([]Enc,
+	error) {
 
-func NewPortLock(port int) *PortLock {
+	// Work out the classes for every known salt id in dc and env and
+	// replace the environment's Enc rows with them, one row per class. A
+	// salt id that gets no classes keeps a single row with an empty
+	// Formula so that it is still known next time. Salt ids are all the
+	// address we have, so a host's rows are marked Untested when cidr
+	// regexes may have changed its classes.
+	//
+	// Endpoints that change regexes, classes or overrides call this with
+	// tx, the transaction making the change, so the Enc rows are saved with
+	// the change or not at all. The caller must hold the lock.
 
-	// NewFLock creates new Flock-based lock (unlocked first)
-	return &PortLock{hostport: net.JoinHostPort("127.0.0.1", strconv.Itoa(port))}
-}
+	encs := []Enc{}
 
-func (p *PortLock) Lock() {
+	matchers, err := LoadMatchers(tx, dc, env)
+	if err != nil {
+		return encs, err
+	}
 
-	// Lock acquires the lock, blocking
-	t := 50 * time.Millisecond
-	for {
-		if l, err := net.Listen("tcp", p.hostport); err == nil {
-			p.ln = l // thanks to zhangpy
-			return
-		}
-		//log.Printf("spinning lock on %s (%s)", p.hostport, err)
-		time.Sleep(t)
-		//t = time.Duration(
-		//  math.Min( float64(time.Duration(float32(t) * 1.5)), 2000 ))
+	overrides, err := LoadOverrides(tx, dc, env)
+	if err != nil {
+		return encs, err
 	}
-}
 
-func (p *PortLock) Unlock() {
+	hosts, err := KnownSaltIds(tx, dc, env, extra)
+	if err != nil {
+		return encs, err
+	}
 
-	// Unlock releases the lock
-	if p.ln != nil {
-		p.ln.Close()
+	for _, saltid := range hosts {
+		results, classes := Evaluate(matchers, saltid, "")
+		classes, _, _ = ApplyOverrides(classes, overrides[saltid])
+		untested := len(UntestedClasses(results)) > 0
+		if len(classes) == 0 {
+			encs = append(encs, Enc{SaltId: saltid, Dc: dc, Env: env,
+				Untested: untested})
+			continue
+		}
+		for _, class := range classes {
+			parts := strings.SplitN(class, ".", 2)
+			enc := Enc{SaltId: saltid, Formula: parts[0], Dc: dc, Env: env,
+				Untested: untested}
+			if len(parts) == 2 {
+				enc.StateFile = parts[1]
+			}
+			encs = append(encs, enc)
+		}
+	}
+
+	if err := tx.Where("dc = ? and env = ?", dc, env).Delete(
+		Enc{}).Error; err != nil {
+		return encs, err
 	}
+	for i := range encs {
+		if err := tx.Create(&encs[i]).Error; err != nil {
+			return encs, err
+		}
+	}
+
+	return encs, nil
 }
 
 // ***************************************************************************
@@ -180,10 +1210,15 @@ type PostedData struct {
 	// Dc and Env are retrieved from the env_id
 	//Dc            string
 	//Env           string
-	Desc  string
-	Id    int64
-	Name  string
-	Regex string
+	Desc       string
+	Id         int64
+	Name       string
+	Regex      string
+	Priority   int64
+	Rule       string
+	MatchType  string
+	IgnoreCase bool
+	FullMatch  bool
 }
 
 func Unlock() {
@@ -240,11 +1275,13 @@ func (t *Plugin) GetRequest(args *Args, response *[]byte) error {
 
 	db := gormInst.DB() // shortcut
 
-	// Search the regexes table
+	// Search the regexes table. Regexes are returned in precedence order,
+	// highest priority first.
 
 	regexes := []Regex{}
 	Lock()
-	if err := db.Find(&regexes, "dc = ? and env = ?", dc, env); err.Error != nil {
+	if err := db.Order("priority desc, id").Find(&regexes, "dc = ? and env = ?",
+		dc, env); err.Error != nil {
 		if !err.RecordNotFound() {
 			Unlock()
 			ReturnError(err.Error.Error(), response)
@@ -264,6 +1301,17 @@ func (t *Plugin) GetRequest(args *Args, response *[]byte) error {
 		u[i]["Env"] = regexes[i].Env
 		u[i]["Name"] = regexes[i].Name
 		u[i]["Desc"] = regexes[i].Desc
+		u[i]["Priority"] = regexes[i].Priority
+		u[i]["Rule"] = regexes[i].Rule
+		if len(regexes[i].Rule) == 0 {
+			u[i]["Rule"] = RuleInclude
+		}
+		u[i]["MatchType"] = regexes[i].MatchType
+		if len(regexes[i].MatchType) == 0 {
+			u[i]["MatchType"] = MatchPcre
+		}
+		u[i]["IgnoreCase"] = regexes[i].IgnoreCase
+		u[i]["FullMatch"] = regexes[i].FullMatch
 	}
 
 	//type JsonOut struct {
@@ -337,6 +1385,18 @@ func (t *Plugin) PostRequest(args *Args, response *[]byte) error {
 		return nil
 	}
 
+	if verr := ValidateRegex(postdata); verr != nil {
+		ReturnValidationError(*verr, response)
+		return nil
+	}
+
+	if len(postdata.Rule) == 0 {
+		postdata.Rule = RuleInclude
+	}
+	if len(postdata.MatchType) == 0 {
+		postdata.MatchType = MatchPcre
+	}
+
 	db := gormInst.DB() // shortcut
 
 	// The following regex will be written to the db
@@ -347,12 +1407,75 @@ func (t *Plugin) PostRequest(args *Args, response *[]byte) error {
 		env,
 		postdata.Name,
 		postdata.Desc,
+		postdata.Priority,
+		postdata.Rule,
+		postdata.MatchType,
+		postdata.IgnoreCase,
+		postdata.FullMatch,
 	}
 
-	// Update the Regex entry
+	// Save the Regex entry, its audit record and a new revision together
+
+	audit := Audit{
+		Login:  args.PathParams["login"],
+		Dc:     dc,
+		Env:    env,
+		Action: AuditCreate,
+		Kind:   AuditRegex,
+	}
 
 	Lock()
-	if err := db.Save(&regex).Error; err != nil {
+	tx := db.Begin()
+	if err := FirstRevision(tx, audit); err != nil {
+		tx.Rollback()
+		Unlock()
+		ReturnError("Revision error: "+err.Error(), response)
+		return nil
+	}
+	if verr, err := CheckNameUnique(tx, dc, env, regex.Name,
+		regex.Id); err != nil || verr != nil {
+		tx.Rollback()
+		Unlock()
+		if err != nil {
+			ReturnError(err.Error(), response)
+		} else {
+			ReturnValidationError(*verr, response)
+		}
+		return nil
+	}
+	if regex.Id, err = NextRegexId(tx); err != nil {
+		tx.Rollback()
+		Unlock()
+		ReturnError("Create error: "+err.Error(), response)
+		return nil
+	}
+	if err := tx.Create(&regex).Error; err != nil {
+		tx.Rollback()
+		Unlock()
+		ReturnError("Create error: "+err.Error(), response)
+		return nil
+	}
+	audit.RegexId = regex.Id
+	if err := WriteAudit(tx, audit, nil, regex); err != nil {
+		tx.Rollback()
+		Unlock()
+		ReturnError("Audit error: "+err.Error(), response)
+		return nil
+	}
+	if err := WriteRevision(tx, audit,
+		"Created regex '"+regex.Name+"'"); err != nil {
+		tx.Rollback()
+		Unlock()
+		ReturnError("Revision error: "+err.Error(), response)
+		return nil
+	}
+	if _, err := RebuildEncs(tx, dc, env, []string{}); err != nil {
+		tx.Rollback()
+		Unlock()
+		ReturnError("Enc rebuild error: "+err.Error(), response)
+		return nil
+	}
+	if err := tx.Commit().Error; err != nil {
 		Unlock()
 		ReturnError("Update error: "+err.Error(), response)
 		return nil
@@ -429,39 +1552,131 @@ func (t *Plugin) PutRequest(args *Args, response *[]byte) error {
 		return nil
 	}
 
+	if verr := ValidateRegex(postdata); verr != nil {
+		ReturnValidationError(*verr, response)
+		return nil
+	}
+
+	if len(postdata.Rule) == 0 {
+		postdata.Rule = RuleInclude
+	}
+	if len(postdata.MatchType) == 0 {
+		postdata.MatchType = MatchPcre
+	}
+
 	db := gormInst.DB() // shortcut
 
-	// Search the regexes table for the regex id
+	// The following regex will be written to the db
+	regex := Regex{
+		postdata.Id,
+		postdata.Regex,
+		dc,
+		env,
+		postdata.Name,
+		postdata.Desc,
+		postdata.Priority,
+		postdata.Rule,
+		postdata.MatchType,
+		postdata.IgnoreCase,
+		postdata.FullMatch,
+	}
+
+	// Save the Regex entry, its audit record and a new revision together.
+	// The regex as it was, for the audit record, and its classes are read
+	// in the same transaction.
+
+	audit := Audit{
+		Login:   args.PathParams["login"],
+		Dc:      dc,
+		Env:     env,
+		Action:  AuditUpdate,
+		Kind:    AuditRegex,
+		RegexId: regex.Id,
+	}
 
 	regexes := []Regex{}
 	Lock()
-	if err := db.Find(&regexes, "id = ? and dc = ? and env = ?", postdata.Id,
+	tx := db.Begin()
+	if err := tx.Find(&regexes, "id = ? and dc = ? and env = ?", postdata.Id,
 		dc, env); err.Error != nil {
 		if !err.RecordNotFound() {
+			tx.Rollback()
 			Unlock()
 			ReturnError(err.Error.Error(), response)
 			return nil
 		}
+	}
+
+	if len(regexes) == 0 {
+		tx.Rollback()
+		Unlock()
 		id := strconv.FormatInt(postdata.Id, 10)
 		ReturnError("Regex Id:"+id+" not found", response)
 		return nil
 	}
-	Unlock()
 
-	// The following regex will be written to the db
-	regex := Regex{
-		postdata.Id,
-		postdata.Regex,
-		dc,
-		env,
-		postdata.Name,
-		postdata.Desc,
+	// Classes using placeholders need the capture groups to still exist
+
+	maps := []RegexSlsMap{}
+	if err := tx.Find(&maps, "regex_id = ?", postdata.Id); err.Error != nil {
+		if !err.RecordNotFound() {
+			tx.Rollback()
+			Unlock()
+			ReturnError(err.Error.Error(), response)
+			return nil
+		}
 	}
 
-	// Update the Regex entry
+	if verr := ValidatePlaceholders(postdata, maps); verr != nil {
+		tx.Rollback()
+		Unlock()
+		ReturnValidationError(*verr, response)
+		return nil
+	}
 
-	Lock()
-	if err := db.Save(&regex).Error; err != nil {
+	if err := FirstRevision(tx, audit); err != nil {
+		tx.Rollback()
+		Unlock()
+		ReturnError("Revision error: "+err.Error(), response)
+		return nil
+	}
+	if verr, err := CheckNameUnique(tx, dc, env, regex.Name,
+		regex.Id); err != nil || verr != nil {
+		tx.Rollback()
+		Unlock()
+		if err != nil {
+			ReturnError(err.Error(), response)
+		} else {
+			ReturnValidationError(*verr, response)
+		}
+		return nil
+	}
+	if err := tx.Save(&regex).Error; err != nil {
+		tx.Rollback()
+		Unlock()
+		ReturnError("Update error: "+err.Error(), response)
+		return nil
+	}
+	if err := WriteAudit(tx, audit, regexes[0], regex); err != nil {
+		tx.Rollback()
+		Unlock()
+		ReturnError("Audit error: "+err.Error(), response)
+		return nil
+	}
+	if err := WriteRevision(tx, audit,
+		"Changed regex '"+regex.Name+"'"); err != nil {
+		tx.Rollback()
+		Unlock()
+		ReturnError("Revision error: "+err.Error(), response)
+		return nil
+	}
+	if _, err := RebuildEncs(tx, dc, env, []string{}); err != nil {
+		tx.Rollback()
+		Unlock()
+		ReturnError("Enc rebuild error: "+err.Error(), response)
+		return nil
+	}
+	if err := tx.Commit().Error; err != nil {
 		Unlock()
 		ReturnError("Update error: "+err.Error(), response)
 		return nil
@@ -532,36 +1747,117 @@ func (t *Plugin) DeleteRequest(args *Args, response *[]byte) error {
 
 	db := gormInst.DB() // shortcut
 
-	// Search the regexes table for the regex id
+	// The following regex will be written to the db
+	regex := Regex{
+		id_int,
+		"",
+		dc,
+		env,
+		"",
+		"",
+		0,
+		"",
+		"",
+		false,
+		false,
+	}
+
+	// Delete the Regex entry and its class mappings together so no
+	// RegexSlsMap is left without a Regex, along with their audit records
+	// and a new revision. The regex and its classes, for the audit trail,
+	// are read in the same transaction.
+
+	audit := Audit{
+		Login:   args.PathParams["login"],
+		Dc:      dc,
+		Env:     env,
+		Action:  AuditDelete,
+		RegexId: id_int,
+	}
 
 	regexes := []Regex{}
 	Lock()
-	if err := db.Find(&regexes, "id = ? and dc = ? and env = ?", id_str,
+	tx := db.Begin()
+	if err := tx.Find(&regexes, "id = ? and dc = ? and env = ?", id_str,
 		dc, env); err.Error != nil {
 		if !err.RecordNotFound() {
+			tx.Rollback()
 			Unlock()
 			ReturnError(err.Error.Error(), response)
 			return nil
 		}
+	}
+
+	if len(regexes) == 0 {
+		tx.Rollback()
+		Unlock()
 		ReturnError("Regex Id:"+id_str+" not found", response)
 		return nil
 	}
-	Unlock()
 
-	// The following regex will be written to the db
-	regex := Regex{
-		id_int,
-		"",
-		dc,
-		env,
-		"",
-		"",
+	maps := []RegexSlsMap{}
+	if err := tx.Find(&maps, "regex_id = ?", id_int); err.Error != nil {
+		if !err.RecordNotFound() {
+			tx.Rollback()
+			Unlock()
+			ReturnError(err.Error.Error(), response)
+			return nil
+		}
 	}
 
-	// Update the Regex entry
+	classes := []string{}
+	for _, m := range maps {
+		classes = append(classes, m.Class())
+	}
 
-	Lock()
-	if err := db.Delete(&regex).Error; err != nil {
+	if err := FirstRevision(tx, audit); err != nil {
+		tx.Rollback()
+		Unlock()
+		ReturnError("Revision error: "+err.Error(), response)
+		return nil
+	}
+	if err := tx.Where("regex_id = ?", id_int).Delete(RegexSlsMap{}).Error; err != nil {
+		tx.Rollback()
+		Unlock()
+		ReturnError("Update error: "+err.Error(), response)
+		return nil
+	}
+	if len(classes) > 0 {
+		audit.Kind = AuditClasses
+		if err := WriteAudit(tx, audit, classes, nil); err != nil {
+			tx.Rollback()
+			Unlock()
+			ReturnError("Audit error: "+err.Error(), response)
+			return nil
+		}
+	}
+	if err := tx.Delete(&regex).Error; err != nil {
+		tx.Rollback()
+		Unlock()
+		ReturnError("Update error: "+err.Error(), response)
+		return nil
+	}
+	audit.Kind = AuditRegex
+	if err := WriteAudit(tx, audit, regexes[0], nil); err != nil {
+		tx.Rollback()
+		Unlock()
+		ReturnError("Audit error: "+err.Error(), response)
+		return nil
+	}
+	if err := WriteRevision(tx, audit,
+		"Deleted regex '"+regexes[0].Name+"'"); err != nil {
+		tx.Rollback()
+		Unlock()
+		ReturnError("Revision error: "+err.Error(), response)
+		return nil
+	}
+	if _, err := RebuildEncs(tx, dc, env, []string{}); err != nil {
+		tx.Rollback()
+		Unlock()
+		ReturnError("Enc rebuild error: "+err.Error(), response)
+		return nil
+	}
+	if err := tx.Commit().Error; err != nil {
 		Unlock()
 		ReturnError("Update error: "+err.Error(), response)
 		return nil
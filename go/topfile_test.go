@@ -0,0 +1,169 @@
+// Obdi - a REST interface and GUI for deploying software
+// Copyright (C) 2014  Mark Clarkson
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Each endpoint is its own program, so run with:
+//
+//   go test topfile.go topfile_test.go obdi_clientlib.go
+
+package main
+
+import (
+	"gopkg.in/yaml.v2"
+	"testing"
+)
+
+func TestTopFileRoundTrip(t *testing.T) {
+
+	// Every top file target RenderTop writes must be read back by the
+	// importer as a regex that gives the same target, with the same flags
+
+	regexes := []Regex{
+		{Id: 1, Name: "xweb", Regex: "web", MatchType: MatchGlob,
+			Rule: RuleExclude, Priority: 10},
+		{Id: 2, Name: "xlist", Regex: "db1, db2", MatchType: MatchList,
+			Rule: RuleExclude, Priority: 10},
+		{Id: 3, Name: "xnets", Regex: "10.9.0.0/16,10.8.0.0/16",
+			MatchType: MatchCidr, Rule: RuleExclude, Priority: 10},
+		{Id: 4, Name: "xpcre", Regex: "test", MatchType: MatchPcre,
+			Rule: RuleExclude, IgnoreCase: true, Priority: 10},
+		{Id: 5, Name: "pcre", Regex: "web\\d+", MatchType: MatchPcre},
+		{Id: 6, Name: "anchored", Regex: "^app", MatchType: MatchPcre},
+		{Id: 7, Name: "full", Regex: "a|b", MatchType: MatchPcre,
+			FullMatch: true},
+		{Id: 8, Name: "icase", Regex: "web.*", MatchType: MatchPcre,
+			IgnoreCase: true},
+		{Id: 9, Name: "icasefull", Regex: "^web.*", MatchType: MatchPcre,
+			IgnoreCase: true, FullMatch: true},
+		{Id: 10, Name: "glob", Regex: "db[0-9]*", MatchType: MatchGlob},
+		{Id: 11, Name: "icaseglob", Regex: "db?", MatchType: MatchGlob,
+			IgnoreCase: true},
+		{Id: 12, Name: "list", Regex: "a1,b2", MatchType: MatchList},
+		{Id: 13, Name: "icaselist", Regex: "a1,b2", MatchType: MatchList,
+			IgnoreCase: true},
+		{Id: 14, Name: "net", Regex: "10.1.0.0/16", MatchType: MatchCidr},
+		{Id: 15, Name: "nets", Regex: "10.1.0.0/16, 10.2.0.0/16",
+			MatchType: MatchCidr},
+		{Id: 16, Name: "excluded", Regex: "^srv", MatchType: MatchPcre},
+		{Id: 17, Name: "alternation", Regex: "^app|db", MatchType: MatchPcre},
+	}
+
+	maps := make(map[int64][]RegexSlsMap)
+	for _, regex := range regexes {
+		maps[regex.Id] = []RegexSlsMap{{RegexId: regex.Id, Formula: regex.Name}}
+	}
+	for _, id := range []int64{1, 2, 3, 4} {
+		maps[16] = append(maps[16], maps[id][0])
+	}
+
+	data, err := yaml.Marshal(RenderTop(regexes, maps, "base"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets, skipped, err := ParseTop(data, "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) > 0 {
+		t.Fatalf("skipped targets: %v", skipped)
+	}
+
+	// Every regex should be found by its key, for every target using it
+
+	keys := make(map[string]Regex)
+	for _, regex := range regexes {
+		if regex.Rule != RuleExclude {
+			regex.Rule = RuleInclude
+		}
+		keys[RegexKey(regex)] = regex
+	}
+
+	found := make(map[int64]bool)
+	for _, target := range targets {
+		include, excludes, err := TargetToRegexes(target.Target, target.Match)
+		if err != nil {
+			t.Errorf("target %q (%s): %v", target.Target, target.Match, err)
+			continue
+		}
+		for _, parsed := range append([]Regex{include}, excludes...) {
+			regex, ok := keys[RegexKey(parsed)]
+			if !ok {
+				t.Errorf("target %q (%s): %+v matches no regex", target.Target,
+					target.Match, parsed)
+				continue
+			}
+			found[regex.Id] = true
+			if parsed.IgnoreCase != regex.IgnoreCase {
+				t.Errorf("regex %s: IgnoreCase is %v", regex.Name,
+					parsed.IgnoreCase)
+			}
+			if regex.MatchType == MatchPcre && (parsed.FullMatch !=
+				regex.FullMatch || parsed.Regex != regex.Regex) {
+				t.Errorf("regex %s: read back as %q, FullMatch %v", regex.Name,
+					parsed.Regex, parsed.FullMatch)
+			}
+			if !regex.IgnoreCase && parsed.MatchType != regex.MatchType {
+				t.Errorf("regex %s: MatchType is %s", regex.Name,
+					parsed.MatchType)
+			}
+		}
+	}
+
+	for _, regex := range regexes {
+		if !found[regex.Id] {
+			t.Errorf("regex %s was not read back", regex.Name)
+		}
+	}
+
+	// Salt's re.match would only find db at the start if ^app|db was
+	// written as it is
+
+	if target, _ := TargetFor(regexes[16]); target != ".*(?:^app|db)" {
+		t.Errorf("regex %s: written as %q", regexes[16].Name, target)
+	}
+}
+
+func TestForeignPcreTarget(t *testing.T) {
+
+	// Salt anchors pcre targets at the start of the salt id, so one not
+	// written by RenderTop must stay anchored once imported
+
+	for target, want := range map[string]string{
+		"web\\d+": "^(?:web\\d+)",
+		"^web|db": "^(?:^web|db)",
+	} {
+		if regex := PcreToRegex(target); regex.Regex != want {
+			t.Errorf("target %q: read as %q", target, regex.Regex)
+		}
+	}
+}
+
+func TestGlobToRegex(t *testing.T) {
+
+	// Salt globs use fnmatch, where only ! negates a set
+
+	for glob, want := range map[string]string{
+		"db[!0-9]": `^db[^0-9]$`,
+		"db[^0-9]": `^db[\^0-9]$`,
+		"web?*":    `^web..*$`,
+	} {
+		if expr := GlobToRegex(glob); expr != want {
+			t.Errorf("glob %q: converted to %q", glob, expr)
+		}
+	}
+}
+
+// vim:ts=2:sw=2
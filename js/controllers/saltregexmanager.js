@@ -348,6 +348,11 @@ mgrApp.controller("saltregexmgrCtrl", function ($scope,$http,$uibModal,$log,
 
     $scope.newregex = {};
     $scope.newregex.Name = ""; // so watch works without error
+    $scope.newregex.Priority = 0;
+    $scope.newregex.Rule = "include";
+    $scope.newregex.MatchType = "pcre";
+    $scope.newregex.IgnoreCase = false;
+    $scope.newregex.FullMatch = false;
     $scope.editregex.title = "Enter details for the new regular expression:"
 
     $scope.editregex.apply_disabled = false;